@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// begetAccountConfig is one of several beget accounts of an issuer, serving
+// the challenge names under its domains
+type begetAccountConfig struct {
+	APILoginSecretRef  secretRef `json:"apiLoginSecretRef"`
+	APIPasswdSecretRef secretRef `json:"apiPasswdSecretRef"`
+	// Domains select the account for the names equal to or under any of them,
+	// the most specific selector of all the accounts wins
+	Domains []string `json:"domains"`
+}
+
+// validateAccounts rejects accounts without selectors and selectors claimed by
+// several accounts, the solver couldn't tell which account to pick for them
+func validateAccounts(accounts []begetAccountConfig, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	owners := make(map[string]int)
+	for i := range accounts {
+		account := &accounts[i]
+		accountPath := path.Index(i)
+
+		errs = append(errs, validateSecretRefs(&account.APILoginSecretRef, &account.APIPasswdSecretRef, accountPath)...)
+
+		if len(account.Domains) == 0 {
+			errs = append(errs, field.Required(accountPath.Child("domains"), "at least one domain selecting the account"))
+		}
+
+		for j, domain := range account.Domains {
+			selector := normalizeSelector(domain)
+			if selector == "" {
+				errs = append(errs, field.Invalid(accountPath.Child("domains").Index(j), domain, "empty domain"))
+
+				continue
+			}
+
+			if owner, ok := owners[selector]; ok && owner != i {
+				errs = append(errs, field.Invalid(accountPath.Child("domains").Index(j), domain,
+					fmt.Sprintf("already selected by %s", path.Index(owner))))
+
+				continue
+			}
+			owners[selector] = i
+		}
+	}
+
+	return errs
+}
+
+// accountFor returns the login and password refs of the account serving fqdn:
+// the account with the longest selector covering it, or the issuer's own refs
+// if no selector covers it; false if the issuer has no refs for fqdn
+func (c begetDNSProviderConfig) accountFor(fqdn string) (secretRef, secretRef, bool) {
+	var (
+		match    *begetAccountConfig
+		matchLen int
+	)
+	for i := range c.Accounts {
+		for _, domain := range c.Accounts[i].Domains {
+			selector := normalizeSelector(domain)
+			if inZone(fqdn, selector) && len(selector) > matchLen {
+				match, matchLen = &c.Accounts[i], len(selector)
+			}
+		}
+	}
+
+	if match != nil {
+		return match.APILoginSecretRef, match.APIPasswdSecretRef, true
+	}
+
+	return c.APILoginSecretRef, c.APIPasswdSecretRef, c.APILoginSecretRef.Name != ""
+}
+
+func normalizeSelector(domain string) string {
+	return strings.ToLower(trimFqdn(strings.TrimSpace(domain)))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSolver_Accounts(t *testing.T) {
+	solver, api := newTestSolver(t)
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	_, err := solver.k8sClient.CoreV1().Secrets("default").Create(context.TODO(), &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "other-credentials", Namespace: "default"},
+		Data: map[string][]byte{
+			"login":  []byte("other"),
+			"passwd": []byte("secret"),
+		},
+	}, v1.CreateOptions{})
+	require.NoError(t, err)
+
+	other := testConfig()
+	other.APILoginSecretRef.Name = "other-credentials"
+	other.APIPasswdSecretRef.Name = "other-credentials"
+
+	cfg := begetDNSProviderConfig{
+		Accounts: []begetAccountConfig{
+			{APILoginSecretRef: other.APILoginSecretRef, APIPasswdSecretRef: other.APIPasswdSecretRef, Domains: []string{"example.com"}},
+			{APILoginSecretRef: testConfig().APILoginSecretRef, APIPasswdSecretRef: testConfig().APIPasswdSecretRef, Domains: []string{"acme.example.com."}},
+		},
+	}
+
+	// the most specific selector routes to the account the mock knows
+	require.NoError(t, solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.acme.example.com.", "challenge", cfg)))
+
+	records, err := api.GetData("_acme-challenge.acme.example.com", creds)
+	require.NoError(t, err)
+	require.Equal(t, []begetapi.TXTRecord{{TXTData: "challenge"}}, records.TXT)
+
+	err = solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.example.com.", "challenge", cfg))
+	require.ErrorContains(t, err, `beget rejected the credentials of secret "default/other-credentials" key "login"`)
+	// the login read from the secret is not told to the readers of the challenge
+	require.NotContains(t, err.Error(), `"other"`)
+
+	err = solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.example.org.", "challenge", cfg))
+	require.ErrorContains(t, err, "no account of the issuer selects _acme-challenge.example.org")
+}
@@ -2,16 +2,31 @@ package begetapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const TXTKey = "TXT"
-const TXTDataKey = "txtdata"
+const (
+	// DefaultRequestTimeout bounds a single HTTP request to the API
+	DefaultRequestTimeout = 30 * time.Second
+	// DefaultTimeout bounds a whole client method call
+	DefaultTimeout = 2 * time.Minute
+
+	tracerName = "github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+)
 
 type Credentials struct {
 	Login  string
@@ -19,90 +34,132 @@ type Credentials struct {
 }
 
 type ApiClient struct {
-	apiURL *url.URL
-	client *http.Client
+	apiURL         *url.URL
+	client         *http.Client
+	requestTimeout time.Duration
+	timeout        time.Duration
+	retryPolicy    RetryPolicy
+	observer       Observer
+	limiter        *accountLimiter
+	tracerProvider trace.TracerProvider
+	tracer         trace.Tracer
 }
 
-func NewApiClient(apiURL *url.URL) *ApiClient {
-	client := http.Client{}
+type Option func(*ApiClient)
 
-	q := apiURL.Query()
-	q.Add("input_format", "json")
-	q.Add("output_format", "json")
+// WithHTTPClient replaces the default http.Client
+func WithHTTPClient(client *http.Client) Option {
+	return func(a *ApiClient) {
+		a.client = client
+	}
+}
 
-	apiURL.RawQuery = q.Encode()
+// WithRequestTimeout sets the timeout of a single HTTP request, zero disables it
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(a *ApiClient) {
+		a.requestTimeout = timeout
+	}
+}
 
-	return &ApiClient{
-		apiURL: apiURL,
-		client: &client,
+// WithTimeout sets the deadline of a whole method call, zero disables it
+func WithTimeout(timeout time.Duration) Option {
+	return func(a *ApiClient) {
+		a.timeout = timeout
 	}
 }
 
-func (a *ApiClient) GetData(fqdn string, credentials Credentials) (Records, error) {
-	u := *a.apiURL
-	u.Path += "/api/dns/getData"
+// WithRetryPolicy sets the policy repeating failed calls, NoRetry disables retries
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(a *ApiClient) {
+		a.retryPolicy = policy
+	}
+}
 
-	q := u.Query()
-	q.Add("login", credentials.Login)
-	q.Add("passwd", credentials.Passwd)
+// WithObserver sets the observer notified of every request to the API
+func WithObserver(observer Observer) Option {
+	return func(a *ApiClient) {
+		a.observer = observer
+	}
+}
 
-	u.RawQuery = q.Encode()
+// WithTracerProvider sets the provider of the spans of the API calls and of
+// their HTTP requests, the global one is used by default
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(a *ApiClient) {
+		a.tracerProvider = provider
+	}
+}
 
-	values := map[string]string{"fqdn": fqdn}
+func NewApiClient(apiURL *url.URL, opts ...Option) *ApiClient {
+	client := http.Client{}
 
-	jsonValue, err := json.Marshal(values)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal a message: %w", err)
-	}
+	q := apiURL.Query()
+	q.Add("input_format", "json")
+	q.Add("output_format", "json")
 
-	buff := bytes.NewBuffer([]byte(""))
-	mp := multipart.NewWriter(buff)
+	apiURL.RawQuery = q.Encode()
 
-	err = mp.WriteField("input_data", string(jsonValue))
-	if err != nil {
-		return nil, fmt.Errorf("failed to write form data: %w", err)
+	a := &ApiClient{
+		apiURL:         apiURL,
+		client:         &client,
+		requestTimeout: DefaultRequestTimeout,
+		timeout:        DefaultTimeout,
+		retryPolicy:    DefaultRetryPolicy(),
+		observer:       noopObserver{},
+		tracerProvider: otel.GetTracerProvider(),
 	}
 
-	err = mp.Close()
-	if err != nil {
-		return nil, fmt.Errorf("failed to close form data: %w", err)
+	for _, opt := range opts {
+		opt(a)
 	}
 
-	r, err := a.client.Post(u.String(), mp.FormDataContentType(), buff)
-	if err != nil {
-		return nil, fmt.Errorf("request for getData failed: %w", err)
-	}
+	a.tracer = a.tracerProvider.Tracer(tracerName)
 
-	if r.StatusCode != 200 {
-		return nil, fmt.Errorf("non 200 response: %d", r.StatusCode)
-	}
+	// the client given with WithHTTPClient is left as is
+	traced := *a.client
+	traced.Transport = otelhttp.NewTransport(traced.Transport,
+		otelhttp.WithTracerProvider(a.tracerProvider),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		}),
+	)
+	a.client = &traced
 
-	bdy, err := io.ReadAll(r.Body)
+	return a
+}
+
+func (a *ApiClient) GetData(fqdn string, credentials Credentials) (Records, error) {
+	return a.GetDataContext(context.Background(), fqdn, credentials)
+}
+
+func (a *ApiClient) GetDataContext(ctx context.Context, fqdn string, credentials Credentials) (Records, error) {
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+
+	values := map[string]string{"fqdn": fqdn}
+
+	bdy, err := a.call(ctx, "dns/getData", values, credentials)
 	if err != nil {
-		return nil, fmt.Errorf("reading response: %w", err)
+		return Records{}, err
 	}
-	r.Body.Close()
 
 	var rsp GetDataResponse
 
 	err = json.Unmarshal(bdy, &rsp)
 	if err != nil {
-		return nil, fmt.Errorf("unmarshal response: %w", err)
+		return Records{}, fmt.Errorf("unmarshal response: %w", err)
 	}
-	fmt.Println(string(bdy), rsp)
 
 	return rsp.Answer.Result.Records, nil
 }
 
 func (a *ApiClient) ChangeRecords(fqdn string, records Records, credentials Credentials) error {
-	u := *a.apiURL
-	u.Path += "/api/dns/changeRecords"
-
-	q := u.Query()
-	q.Add("login", credentials.Login)
-	q.Add("passwd", credentials.Passwd)
+	return a.ChangeRecordsContext(context.Background(), fqdn, records, credentials)
+}
 
-	u.RawQuery = q.Encode()
+func (a *ApiClient) ChangeRecordsContext(ctx context.Context, fqdn string, records Records, credentials Credentials) error {
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
 
 	values := struct {
 		FQDN    string  `json:"fqdn"`
@@ -112,50 +169,171 @@ func (a *ApiClient) ChangeRecords(fqdn string, records Records, credentials Cred
 		Records: records,
 	}
 
-	jsonValue, err := json.Marshal(values)
+	bdy, err := a.call(ctx, "dns/changeRecords", values, credentials)
 	if err != nil {
-		return fmt.Errorf("failed to marshal a message: %w", err)
+		return err
+	}
+
+	var result ChangeRecordsResponse
+	err = json.Unmarshal(bdy, &result)
+	if err != nil {
+		return fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	if !result.Answer.Result {
+		return resultFalseError(bdy, fmt.Sprintf("records of %s are not changed", fqdn))
+	}
+
+	return nil
+}
+
+func (a *ApiClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, a.timeout)
+}
+
+// call posts input as input_data to the API method and returns the response body,
+// repeating the request as long as the retry policy allows
+func (a *ApiClient) call(ctx context.Context, method string, input interface{}, credentials Credentials) (_ []byte, err error) {
+	ctx, span := a.tracer.Start(ctx, "beget "+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("beget.method", method)),
+	)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	u := *a.apiURL
+	u.Path += "/api/" + method
+
+	jsonValue, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal a message: %w", err)
 	}
 
 	buff := bytes.NewBuffer([]byte(""))
 	mp := multipart.NewWriter(buff)
 
+	// credentials go in the body to stay out of logs and errors carrying the URL
+	err = mp.WriteField("login", credentials.Login)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write form data: %w", err)
+	}
+
+	err = mp.WriteField("passwd", credentials.Passwd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write form data: %w", err)
+	}
+
 	err = mp.WriteField("input_data", string(jsonValue))
 	if err != nil {
-		return fmt.Errorf("failed to write form data: %w", err)
+		return nil, fmt.Errorf("failed to write form data: %w", err)
 	}
 
 	err = mp.Close()
 	if err != nil {
-		return fmt.Errorf("failed to close form data: %w", err)
+		return nil, fmt.Errorf("failed to close form data: %w", err)
 	}
 
-	r, err := a.client.Post(u.String(), mp.FormDataContentType(), buff)
+	for attempt := 1; ; attempt++ {
+		// every attempt counts against the limit of the account
+		if err := a.waitForRateLimit(ctx, method, credentials.Login); err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		bdy, err := a.do(ctx, method, u.String(), mp.FormDataContentType(), buff.Bytes())
+		a.observer.ObserveRequest(method, time.Since(start), err)
+		if err == nil {
+			return bdy, nil
+		}
+
+		delay, retry := a.retryPolicy.Retry(attempt, err)
+		if !retry || ctx.Err() != nil {
+			if attempt > 1 {
+				return nil, fmt.Errorf("%s failed after %d attempts: %w", method, attempt, err)
+			}
+
+			return nil, err
+		}
+
+		a.observer.ObserveRetry(method, attempt, err)
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("beget.attempt", attempt)))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return nil, fmt.Errorf("%s failed after %d attempts: %w", method, attempt, err)
+		case <-timer.C:
+		}
+	}
+}
+
+// do makes a single request to the API
+func (a *ApiClient) do(ctx context.Context, method, u, contentType string, payload []byte) ([]byte, error) {
+	if a.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.requestTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(payload))
 	if err != nil {
-		return fmt.Errorf("request for getData failed: %w", err)
+		return nil, fmt.Errorf("building request for %s: %w", method, err)
 	}
+	req.Header.Set("Content-Type", contentType)
+
+	r, err := a.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactURL(urlErr.URL)
+		}
+
+		return nil, fmt.Errorf("request for %s failed: %w", method, err)
+	}
+	defer r.Body.Close()
 
 	bdy, err := io.ReadAll(r.Body)
 	if err != nil {
-		return fmt.Errorf("reading response: %w", err)
+		return nil, fmt.Errorf("reading response: %w", err)
 	}
-	r.Body.Close()
 
 	if r.StatusCode != 200 {
-		return fmt.Errorf("non 200 response: %d %s", r.StatusCode, bdy)
+		return nil, &APIError{HTTPStatus: r.StatusCode, Body: bdy}
 	}
 
-	var result ChangeRecordsResponse
-	err = json.Unmarshal(bdy, &result)
+	if apiErr := parseAPIError(bdy); apiErr != nil {
+		return nil, apiErr
+	}
+
+	return bdy, nil
+}
+
+// redactURL hides secrets a URL may carry, e.g. credentials of the API URL
+// given by a user in the query
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		return fmt.Errorf("unmarshal response: %w", err)
+		return "<unparsable url>"
 	}
 
-	if !result.Answer.Result {
-		return fmt.Errorf("got result status in response: %s, body: %s", result.Answer.Status, bdy)
+	q := u.Query()
+	if q.Has("passwd") {
+		q.Set("passwd", "xxxxx")
+		u.RawQuery = q.Encode()
 	}
 
-	return nil
+	return u.Redacted()
 }
 
 type GetDataResponse struct {
@@ -173,52 +351,3 @@ type ChangeRecordsResponse struct {
 		Result bool   `json:"result"`
 	} `json:"answer"`
 }
-
-func PushTXTRecord(r Records, txtData string) error {
-	if _, ok := r[TXTKey]; ok && len(r[TXTKey]) > 0 {
-		for i, _ := range r[TXTKey] {
-			existingData, isStr := r[TXTKey][i][TXTDataKey].(string)
-			if isStr && existingData == txtData {
-				return nil
-			}
-		}
-
-		var newTxtElement map[string]interface{}
-		r[TXTKey] = append(r[TXTKey], newTxtElement)
-
-		r[TXTKey][len(r[TXTKey])-1][TXTDataKey] = txtData
-	} else {
-		if r == nil {
-			r = make(Records)
-		}
-		r[TXTKey] = make([]map[string]interface{}, 1)
-		r[TXTKey][0] = make(map[string]interface{}, 1)
-		r[TXTKey][0][TXTDataKey] = txtData
-	}
-
-	return nil
-}
-
-func PopTXTRecordByValue(r Records, txtData string) int {
-	deleted := 0
-	if _, ok := r[TXTKey]; ok && len(r[TXTKey]) > 0 {
-		for i := range r[TXTKey] {
-			if r[TXTKey][i] == nil {
-				continue
-			}
-
-			if _, ok := r[TXTKey][i][TXTDataKey]; !ok {
-				continue
-			}
-
-			existingData, isStr := r[TXTKey][i][TXTDataKey].(string)
-			if isStr && existingData == txtData {
-				r[TXTKey] = append(r[TXTKey][:i], r[TXTKey][i+1:]...)
-
-				deleted++
-			}
-		}
-	}
-
-	return deleted
-}
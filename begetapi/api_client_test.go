@@ -2,11 +2,17 @@ package begetapi_test
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -18,19 +24,29 @@ type ApiClientTestSuite struct {
 
 func (suite *ApiClientTestSuite) SetupTest() {
 	suite.begetApi = begetapi.NewBegetApiMock("login", "password")
+	suite.begetApi.AddDomain("example.com")
+	for _, name := range []string{"api.example.com", "_acme-challenge.example.com"} {
+		_, err := suite.begetApi.AddSubdomain(name)
+		suite.Require().NoError(err)
+	}
 	go func() {
 		suite.begetApi.Run(":12943")
 	}()
+	suite.Require().NoError(waitForServer("localhost:12943"))
+
 	url, err := url.Parse("http://localhost:12943")
 	suite.Require().NoError(err)
 
 	suite.client = begetapi.NewApiClient(
 		url,
+		begetapi.WithRetryPolicy(&begetapi.ExponentialBackoff{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond}),
 	)
 }
 
-func (suite *ApiClientTestSuite) TearDownSuite() {
+func (suite *ApiClientTestSuite) TearDownTest() {
 	suite.begetApi.Stop(context.TODO())
+	// the client shares the default transport, its connections are dead now
+	http.DefaultClient.CloseIdleConnections()
 }
 
 func TestApiClientTestSuiteSuite(t *testing.T) {
@@ -52,7 +68,7 @@ func (suite *ApiClientTestSuite) TestApiClient_GetChangedRecords() {
 	suite.Require().NoError(err)
 	suite.Require().Empty(records)
 
-	begetapi.PushTXTRecord(records, "mydemo")
+	begetapi.PushTXTRecord(&records, "mydemo")
 
 	err = suite.client.ChangeRecords("api.example.com", records, begetapi.Credentials{Login: "login", Passwd: "password"})
 	suite.Require().NoError(err)
@@ -62,43 +78,439 @@ func (suite *ApiClientTestSuite) TestApiClient_GetChangedRecords() {
 	suite.Require().NotEmpty(newRecords)
 }
 
+func (suite *ApiClientTestSuite) TestApiClient_PushTXTRecord_KeepsOtherRecords() {
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+	fqdn := "_acme-challenge.example.com"
+
+	err := suite.client.ChangeRecords(fqdn, begetapi.Records{
+		A:   []begetapi.ARecord{{Address: "127.0.0.1"}},
+		MX:  []begetapi.MXRecord{{Exchange: "mx.example.com", Preference: 10}},
+		TXT: []begetapi.TXTRecord{{TXTData: "v=spf1 -all"}},
+	}, creds)
+	suite.Require().NoError(err)
+
+	records, err := suite.client.GetData(fqdn, creds)
+	suite.Require().NoError(err)
+	suite.Require().NoError(begetapi.PushTXTRecord(&records, "challenge"))
+
+	err = suite.client.ChangeRecords(fqdn, records, creds)
+	suite.Require().NoError(err)
+
+	records, err = suite.client.GetData(fqdn, creds)
+	suite.Require().NoError(err)
+	suite.Equal("127.0.0.1", records.A[0].Address)
+	suite.Equal("mx.example.com", records.MX[0].Exchange)
+	suite.Require().Len(records.TXT, 2)
+	suite.Equal("v=spf1 -all", records.TXT[0].TXTData)
+	suite.Equal("challenge", records.TXT[1].TXTData)
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_RetryServerErrors() {
+	suite.begetApi.FailNext(2, http.StatusServiceUnavailable, "")
+
+	_, err := suite.client.GetData("api.example.com", begetapi.Credentials{Login: "login", Passwd: "password"})
+	suite.Require().NoError(err)
+	suite.Equal(3, suite.begetApi.Calls())
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_RetryLimitError() {
+	limitErr := fmt.Sprintf(begetapi.ErrTemplate, "success", "error", "LIMIT_ERROR", `"Request limit exceeded"`)
+	suite.begetApi.FailNext(1, http.StatusOK, limitErr)
+
+	err := suite.client.ChangeRecords("api.example.com", begetapi.Records{}, begetapi.Credentials{Login: "login", Passwd: "password"})
+	suite.Require().NoError(err)
+	suite.Equal(2, suite.begetApi.Calls())
+}
+
+type recordingObserver struct {
+	requests []error
+	retries  []int
+	waits    []time.Duration
+}
+
+func (o *recordingObserver) ObserveRequest(method string, _ time.Duration, err error) {
+	o.requests = append(o.requests, err)
+}
+
+func (o *recordingObserver) ObserveRetry(method string, attempt int, _ error) {
+	o.retries = append(o.retries, attempt)
+}
+
+func (o *recordingObserver) ObserveRateLimitWait(method string, wait time.Duration) {
+	o.waits = append(o.waits, wait)
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_Observer() {
+	u, err := url.Parse("http://localhost:12943")
+	suite.Require().NoError(err)
+
+	observer := &recordingObserver{}
+	client := begetapi.NewApiClient(u,
+		begetapi.WithRetryPolicy(&begetapi.ExponentialBackoff{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond}),
+		begetapi.WithObserver(observer),
+	)
+
+	suite.begetApi.FailNext(1, http.StatusServiceUnavailable, "")
+
+	_, err = client.GetData("api.example.com", begetapi.Credentials{Login: "login", Passwd: "password"})
+	suite.Require().NoError(err)
+
+	suite.Require().Len(observer.requests, 2)
+	suite.Error(observer.requests[0])
+	suite.NoError(observer.requests[1])
+	suite.Equal([]int{1}, observer.retries)
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_RateLimit() {
+	u, err := url.Parse("http://localhost:12943")
+	suite.Require().NoError(err)
+
+	observer := &recordingObserver{}
+	client := begetapi.NewApiClient(u, begetapi.WithRateLimit(20, 1), begetapi.WithObserver(observer))
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := client.GetData("api.example.com", creds)
+		suite.Require().NoError(err)
+	}
+	suite.GreaterOrEqual(time.Since(start), 90*time.Millisecond)
+	suite.Len(observer.waits, 3)
+
+	// every account has its own bucket
+	_, err = client.GetData("api.example.com", begetapi.Credentials{Login: "other", Passwd: "password"})
+	suite.True(begetapi.IsAuthFailed(err))
+	suite.Less(observer.waits[3], 20*time.Millisecond)
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_RateLimitCanceled() {
+	u, err := url.Parse("http://localhost:12943")
+	suite.Require().NoError(err)
+
+	client := begetapi.NewApiClient(u, begetapi.WithRateLimit(0.1, 1))
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	_, err = client.GetData("api.example.com", creds)
+	suite.Require().NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = client.GetDataContext(ctx, "api.example.com", creds)
+	suite.ErrorContains(err, "waiting for the rate limit of dns/getData")
+	suite.True(begetapi.IsRateLimited(err))
+	suite.Less(time.Since(start), time.Second)
+	suite.Equal(1, suite.begetApi.Calls())
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_RetryGivesUp() {
+	suite.begetApi.FailNext(5, http.StatusBadGateway, "")
+
+	_, err := suite.client.GetData("api.example.com", begetapi.Credentials{Login: "login", Passwd: "password"})
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "after 3 attempts")
+	suite.Equal(3, suite.begetApi.Calls())
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_NoRetryOnPermanentErrors() {
+	_, err := suite.client.GetData("api.example.com", begetapi.Credentials{Login: "login", Passwd: "wrong"})
+	suite.Require().Error(err)
+	suite.Equal(1, suite.begetApi.Calls())
+
+	invalidData := fmt.Sprintf(begetapi.ErrTemplate, "success", "error", "INVALID_DATA", `"Incorrect input data"`)
+	suite.begetApi.FailNext(1, http.StatusOK, invalidData)
+
+	_, err = suite.client.GetData("api.example.com", begetapi.Credentials{Login: "login", Passwd: "password"})
+	suite.Require().Error(err)
+	suite.Equal(2, suite.begetApi.Calls())
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_APIErrors() {
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	_, err := suite.client.GetData("api.example.com", begetapi.Credentials{Login: "login", Passwd: "wrong"})
+	suite.True(begetapi.IsAuthFailed(err), "%v", err)
+
+	suite.begetApi.FailNext(1, http.StatusOK, fmt.Sprintf(begetapi.ErrTemplate, "success", "error", "METHOD_FAILED", `"Failed to get DNS\nrecords"`))
+	_, err = suite.client.GetData("api.example.com", creds)
+	suite.True(begetapi.IsNotFound(err), "%v", err)
+
+	suite.begetApi.FailNext(1, http.StatusOK, fmt.Sprintf(begetapi.ErrTemplate, "success", "error", "METHOD_FAILED", `{"type":"NOT_FOUND_ERROR","message":null}`))
+	err = suite.client.ChangeRecords("api.example.com", begetapi.Records{}, creds)
+	suite.True(begetapi.IsNotFound(err), "%v", err)
+
+	var apiErr *begetapi.APIError
+	suite.Require().ErrorAs(err, &apiErr)
+	suite.Equal("success", apiErr.Status)
+	suite.Equal("error", apiErr.AnswerStatus)
+	suite.Equal([]begetapi.ErrorEntry{{Code: "METHOD_FAILED", Text: `{"type":"NOT_FOUND_ERROR","message":null}`}}, apiErr.Errors)
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_ErrorsDoNotLeakPassword() {
+	const password = "s3cr3t-passw0rd"
+	creds := begetapi.Credentials{Login: "login", Passwd: password}
+
+	_, err := suite.client.GetData("api.example.com", creds)
+	suite.Require().Error(err)
+	suite.NotContains(err.Error(), password)
+
+	// as many failures as requests are made, none are left for the next steps
+	for status, attempts := range map[int]int{http.StatusForbidden: 1, http.StatusInternalServerError: 3} {
+		calls := suite.begetApi.Calls()
+		suite.begetApi.FailNext(attempts, status, "")
+		_, err = suite.client.GetData("api.example.com", creds)
+		suite.Require().Error(err)
+		suite.NotContains(err.Error(), password)
+		suite.Equal(calls+attempts, suite.begetApi.Calls(), "status %d", status)
+	}
+
+	suite.begetApi.FailNext(1, http.StatusOK, fmt.Sprintf(begetapi.ErrTemplate, "success", "error", "METHOD_FAILED", `{"type":"NOT_FOUND_ERROR","message":null}`))
+	err = suite.client.ChangeRecords("api.example.com", begetapi.Records{}, creds)
+	suite.True(begetapi.IsNotFound(err), "%v", err)
+	suite.NotContains(err.Error(), password)
+
+	// nothing listens there, the error carries the URL
+	u, err := url.Parse("http://localhost:1/?passwd=" + password)
+	suite.Require().NoError(err)
+	client := begetapi.NewApiClient(u, begetapi.WithRetryPolicy(begetapi.NoRetry))
+
+	_, err = client.GetData("api.example.com", creds)
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "localhost:1")
+	suite.NotContains(err.Error(), password)
+}
+
+func TestApiClient_ChangeRecords_ResultFalse(t *testing.T) {
+	for name, tc := range map[string]struct {
+		response string
+		errors   []begetapi.ErrorEntry
+	}{
+		"without errors": {
+			response: `{"status":"success","answer":{"status":"success","result":false}}`,
+			errors: []begetapi.ErrorEntry{{
+				Code: begetapi.ErrorCodeResultFalse,
+				Text: `records of api.example.com are not changed, response: {"status":"success","answer":{"status":"success","result":false}}`,
+			}},
+		},
+		"with errors": {
+			response: `{"status":"success","answer":{"status":"success","result":false,"errors":[{"error_code":"INVALID_DATA","error_text":"Неверная запись"}]}}`,
+			errors:   []begetapi.ErrorEntry{{Code: begetapi.ErrorCodeInvalidData, Text: "Неверная запись"}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tc.response))
+			}))
+			defer srv.Close()
+
+			u, err := url.Parse(srv.URL)
+			require.NoError(t, err)
+
+			err = begetapi.NewApiClient(u).ChangeRecords("api.example.com", begetapi.Records{}, begetapi.Credentials{Login: "login", Passwd: "password"})
+
+			var apiErr *begetapi.APIError
+			require.ErrorAs(t, err, &apiErr)
+			require.Equal(t, tc.errors, apiErr.Errors)
+			require.Equal(t, tc.response, string(apiErr.Body))
+			require.Contains(t, err.Error(), tc.errors[0].Text)
+			require.False(t, begetapi.IsRetryable(err))
+		})
+	}
+}
+
+func TestApiClient_CredentialsInBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.False(t, r.URL.Query().Has("login"))
+		assert.False(t, r.URL.Query().Has("passwd"))
+
+		assert.NoError(t, r.ParseMultipartForm(1<<20))
+		assert.Equal(t, "login", r.PostFormValue("login"))
+		assert.Equal(t, "password", r.PostFormValue("passwd"))
+
+		w.Write([]byte(`{"status":"success","answer":{"status":"success","result":true}}`))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	err = begetapi.NewApiClient(u).ChangeRecords("api.example.com", begetapi.Records{}, begetapi.Credentials{Login: "login", Passwd: "password"})
+	assert.NoError(t, err)
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_UnknownName() {
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	_, err := suite.client.GetData("unknown.example.com", creds)
+	suite.True(begetapi.IsNotFound(err), "%v", err)
+
+	err = suite.client.ChangeRecords("unknown.example.com", begetapi.Records{}, creds)
+	suite.True(begetapi.IsNotFound(err), "%v", err)
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_Subdomains() {
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	domains, err := suite.client.GetDomainList(creds)
+	suite.Require().NoError(err)
+	suite.Require().Len(domains, 1)
+	suite.Equal("example.com", domains[0].FQDN)
+
+	id, err := suite.client.AddSubdomainVirtual("_acme-challenge.www", domains[0].ID, creds)
+	suite.Require().NoError(err)
+
+	_, err = suite.client.AddSubdomainVirtual("_acme-challenge.www", domains[0].ID, creds)
+	suite.Require().Error(err)
+
+	subdomains, err := suite.client.GetSubdomainList(creds)
+	suite.Require().NoError(err)
+	suite.Contains(subdomains, begetapi.Subdomain{ID: id, FQDN: "_acme-challenge.www.example.com", DomainID: domains[0].ID})
+
+	_, err = suite.client.GetData("_acme-challenge.www.example.com", creds)
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(suite.client.DeleteSubdomain(id, creds))
+
+	_, err = suite.client.GetData("_acme-challenge.www.example.com", creds)
+	suite.True(begetapi.IsNotFound(err), "%v", err)
+
+	err = suite.client.DeleteSubdomain(id, creds)
+	suite.True(begetapi.IsNotFound(err), "%v", err)
+}
+
+func TestApiClient_RequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	client := begetapi.NewApiClient(u, begetapi.WithRequestTimeout(50*time.Millisecond), begetapi.WithRetryPolicy(begetapi.NoRetry))
+
+	_, err = client.GetData("api.example.com", begetapi.Credentials{Login: "login", Passwd: "password"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestApiClient_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	client := begetapi.NewApiClient(u, begetapi.WithRequestTimeout(0), begetapi.WithTimeout(50*time.Millisecond))
+
+	err = client.ChangeRecords("api.example.com", begetapi.Records{}, begetapi.Credentials{Login: "login", Passwd: "password"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestApiClient_ContextCanceled(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	client := begetapi.NewApiClient(u)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = client.GetDataContext(ctx, "api.example.com", begetapi.Credentials{Login: "login", Passwd: "password"})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
 func TestApiClient_PushTXTRecord(t *testing.T) {
-	r := make(begetapi.Records)
+	r := begetapi.Records{}
 
-	err := begetapi.PushTXTRecord(r, "test")
+	err := begetapi.PushTXTRecord(&r, "test")
 
 	assert.NoError(t, err)
-	assert.Equal(t, "test", r[begetapi.TXTKey][0][begetapi.TXTDataKey])
+	assert.Equal(t, "test", r.TXT[0].TXTData)
 }
 
 func TestApiClient_PushTXTRecord_NotEmpty(t *testing.T) {
-	r := make(begetapi.Records)
-	r["SomeKey"] = make([]map[string]interface{}, 1)
+	r := begetapi.Records{}
+	r.A = make([]begetapi.ARecord, 1)
 
-	err := begetapi.PushTXTRecord(r, "test")
+	err := begetapi.PushTXTRecord(&r, "test")
 
 	assert.NoError(t, err)
-	assert.Equal(t, "test", r[begetapi.TXTKey][0][begetapi.TXTDataKey])
+	assert.Equal(t, "test", r.TXT[0].TXTData)
+}
+
+func TestApiClient_PushTXTRecord_Existing(t *testing.T) {
+	r := begetapi.Records{}
+
+	assert.NoError(t, begetapi.PushTXTRecord(&r, "first"))
+	assert.NoError(t, begetapi.PushTXTRecord(&r, "second"))
+	assert.NoError(t, begetapi.PushTXTRecord(&r, "second"))
+
+	assert.Len(t, r.TXT, 2)
+	assert.Equal(t, "second", r.TXT[1].TXTData)
 }
 
 func TestApiClient_PopTXTRecord(t *testing.T) {
-	r := make(begetapi.Records)
+	r := begetapi.Records{}
 
-	err := begetapi.PushTXTRecord(r, "test")
-	cnt := begetapi.PopTXTRecordByValue(r, "test")
+	err := begetapi.PushTXTRecord(&r, "test")
+	cnt := begetapi.PopTXTRecordByValue(&r, "test")
 
 	assert.NoError(t, err)
 	assert.Equal(t, 1, cnt)
 }
 
 func TestApiClient_PopTXTRecord_NotEmpty(t *testing.T) {
-	r := make(begetapi.Records)
+	r := begetapi.Records{}
 
-	r["SomeKey"] = make([]map[string]interface{}, 1)
+	r.A = make([]begetapi.ARecord, 1)
 
-	err := begetapi.PushTXTRecord(r, "test")
-	cnt := begetapi.PopTXTRecordByValue(r, "test")
+	err := begetapi.PushTXTRecord(&r, "test")
+	cnt := begetapi.PopTXTRecordByValue(&r, "test")
 
 	assert.NoError(t, err)
 	assert.Equal(t, 1, cnt)
 }
+
+// waitForServer blocks until the mock accepts connections on addr
+func waitForServer(addr string) error {
+	var err error
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err == nil {
+			return conn.Close()
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return err
+}
+
+func TestApiClient_PopTXTRecord_KeepsOtherValues(t *testing.T) {
+	r := begetapi.Records{}
+
+	assert.NoError(t, begetapi.PushTXTRecord(&r, "apex"))
+	assert.NoError(t, begetapi.PushTXTRecord(&r, "wildcard"))
+	assert.NoError(t, begetapi.PushTXTRecord(&r, "other"))
+
+	cnt := begetapi.PopTXTRecordByValue(&r, "wildcard")
+
+	assert.Equal(t, 1, cnt)
+	assert.Len(t, r.TXT, 2)
+	assert.Equal(t, "apex", r.TXT[0].TXTData)
+	assert.Equal(t, "other", r.TXT[1].TXTData)
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sort"
 	"sync"
 
 	"github.com/miekg/dns"
@@ -15,25 +17,47 @@ const ErrTemplate = `{"status":"%s","answer":{"status":"%s","errors":[{"error_co
 
 // Simplified API-mock, accepting json POST's
 type BegetApiMock struct {
-	login  string
-	passwd string
-	server *http.Server
-
-	dnsServer  *dns.Server
-	txtRecords map[string]Records
+	// accounts maps the logins accepted by the API to their state
+	accounts map[string]*mockAccount
+	// defaultLogin is the account AddDomain adds domains to
+	defaultLogin string
+	server       *http.Server
+
+	dnsServer *dns.Server
+	lastID    int
+	failures  []injectedFailure
+	calls     int
 	sync.RWMutex
 }
 
+type injectedFailure struct {
+	status int
+	body   string
+}
+
 func NewBegetApiMock(login string, passwd string) *BegetApiMock {
 	return &BegetApiMock{
-		login:      login,
-		passwd:     passwd,
-		txtRecords: make(map[string]Records),
+		accounts:     map[string]*mockAccount{login: newMockAccount(passwd)},
+		defaultLogin: login,
 	}
 }
 
 func (b *BegetApiMock) Run(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return b.Serve(l)
+}
+
+// Serve serves the API on the listener until Stop, a listener bound to port 0
+// lets tests run mocks side by side and read the address back from it
+func (b *BegetApiMock) Serve(l net.Listener) error {
+	b.Lock()
 	if b.server != nil {
+		b.Unlock()
+		l.Close()
 		return errors.New("server is running")
 	}
 
@@ -57,35 +81,200 @@ func (b *BegetApiMock) Run(addr string) error {
 		),
 	)
 
-	b.server = &http.Server{Addr: addr, Handler: mux}
+	for path, handler := range map[string]http.HandlerFunc{
+		"/api/domain/getList":             b.DomainGetList,
+		"/api/domain/getSubdomainList":    b.DomainGetSubdomainList,
+		"/api/domain/addSubdomainVirtual": b.DomainAddSubdomainVirtual,
+		"/api/domain/deleteSubdomain":     b.DomainDeleteSubdomain,
+	} {
+		mux.Handle(path, b.authMiddleware(baseParamsCheckMiddleware(handler)))
+	}
 
-	return b.server.ListenAndServe()
+	server := &http.Server{Handler: b.failureMiddleware(mux)}
+	b.server = server
+	b.Unlock()
+
+	return server.Serve(l)
+}
+
+// RunDns serves the DNS records of the mock over UDP on the port of all
+// interfaces until StopDns, see RunDnsAddr
+func (b *BegetApiMock) RunDns(port string) error {
+	return b.RunDnsAddr(":" + port)
+}
+
+// RunDnsAddr serves the DNS records of the mock over UDP on the address
+func (b *BegetApiMock) RunDnsAddr(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		// e.g. the address is in use, the server may be started again
+		return err
+	}
+
+	return b.ServeDns(conn)
 }
 
-func (b *BegetApiMock) RunDns(port string) {
+// ServeDns serves the DNS records of the mock on the connection until StopDns
+func (b *BegetApiMock) ServeDns(conn net.PacketConn) error {
+	b.Lock()
+	if b.dnsServer != nil {
+		b.Unlock()
+		conn.Close()
+		return errors.New("dns server is running")
+	}
+
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler:    dns.HandlerFunc(b.handleDNSRequest),
+	}
+	b.dnsServer = server
+	b.Unlock()
 
-	b.dnsServer = &dns.Server{
-		Addr:    ":" + port,
-		Net:     "udp",
-		Handler: dns.HandlerFunc(b.handleDNSRequest),
+	err := server.ActivateAndServe()
+	if err != nil {
+		b.Lock()
+		if b.dnsServer == server {
+			b.dnsServer = nil
+		}
+		b.Unlock()
 	}
 
-	b.dnsServer.ListenAndServe()
+	return err
 }
 
 func (b *BegetApiMock) Stop(ctx context.Context) error {
-	return b.server.Shutdown(ctx)
+	b.Lock()
+	server := b.server
+	b.server = nil
+	b.Unlock()
+
+	if server == nil {
+		return nil
+	}
+
+	return server.Shutdown(ctx)
 }
 
 func (b *BegetApiMock) StopDns(_ context.Context) error {
-	return b.dnsServer.Shutdown()
+	b.Lock()
+	server := b.dnsServer
+	b.dnsServer = nil
+	b.Unlock()
+
+	if server == nil {
+		return nil
+	}
+
+	return server.Shutdown()
+}
+
+// FailNext makes the next n API calls respond with the given status and body
+func (b *BegetApiMock) FailNext(n int, status int, body string) {
+	b.Lock()
+	defer b.Unlock()
+
+	for i := 0; i < n; i++ {
+		b.failures = append(b.failures, injectedFailure{status: status, body: body})
+	}
+}
+
+// Calls returns the number of API calls served, including failed ones
+func (b *BegetApiMock) Calls() int {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.calls
+}
+
+// AddAccount makes the API accept another login and password
+func (b *BegetApiMock) AddAccount(login, passwd string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if a, ok := b.accounts[login]; ok {
+		a.passwd = passwd
+		return
+	}
+	b.accounts[login] = newMockAccount(passwd)
+}
+
+// AddDomain adds a domain to the account the mock is created with, as if it
+// was added in beget's panel
+func (b *BegetApiMock) AddDomain(fqdn string) int {
+	id, err := b.AddAccountDomain(b.defaultLogin, fqdn)
+	if err != nil {
+		panic(err)
+	}
+
+	return id
+}
+
+// AddAccountDomain adds a domain to the account with the login
+func (b *BegetApiMock) AddAccountDomain(login, fqdn string) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.addDomain(login, fqdn)
+}
+
+// AddSubdomain adds a subdomain to the domain it belongs to, whichever account
+// owns it
+func (b *BegetApiMock) AddSubdomain(fqdn string) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.hasName(fqdn) {
+		return 0, fmt.Errorf("%s is already added", normalizeName(fqdn))
+	}
+
+	d, ok := b.zoneOf(fqdn)
+	if !ok {
+		return 0, fmt.Errorf("no domain for %s", fqdn)
+	}
+
+	return b.addSubdomain(d, fqdn), nil
+}
+
+// SetRecords replaces the records of a domain or a subdomain, as if they were
+// changed in beget's panel
+func (b *BegetApiMock) SetRecords(fqdn string, records Records) error {
+	b.Lock()
+	defer b.Unlock()
+
+	d, stored, ok := b.records(fqdn)
+	if !ok {
+		return fmt.Errorf("no domain or subdomain %s", normalizeName(fqdn))
+	}
+	*stored = records
+	d.changed()
+
+	return nil
+}
+
+// LookupRecords returns the records of a domain or a subdomain
+func (b *BegetApiMock) LookupRecords(fqdn string) (Records, bool) {
+	b.RLock()
+	defer b.RUnlock()
+
+	_, records, ok := b.records(fqdn)
+	if !ok {
+		return Records{}, false
+	}
+
+	return *records, true
+}
+
+// HasName reports whether the name is a domain or a subdomain of any account
+func (b *BegetApiMock) HasName(fqdn string) bool {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.hasName(fqdn)
 }
 
 // API handlers
 
 func (b *BegetApiMock) DnsChangeRecords(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("\n\nDnsChangeRecords")
-
 	var v ChangeRecordsRequest
 	err := json.Unmarshal([]byte(req.FormValue("input_data")), &v)
 	if err != nil {
@@ -95,8 +284,15 @@ func (b *BegetApiMock) DnsChangeRecords(w http.ResponseWriter, req *http.Request
 	}
 
 	b.Lock()
-	b.txtRecords[v.FQDN] = v.Records
-	b.txtRecords[untrimTrimmedFqdn(v.FQDN)] = v.Records // for tests
+	d, records, ok := b.accounts[req.FormValue("login")].records(v.FQDN)
+	if !ok {
+		b.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(getJsonErrorChangeUnknownDnsRecords()))
+		return
+	}
+	*records = v.Records
+	d.changed()
 	b.Unlock()
 
 	w.WriteHeader(http.StatusOK)
@@ -105,9 +301,6 @@ func (b *BegetApiMock) DnsChangeRecords(w http.ResponseWriter, req *http.Request
 
 // The real API gives back results only if the domain is created in beget's panel
 func (b *BegetApiMock) DnsGetData(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("\n\nDnsGetData")
-	fmt.Println(req.FormValue("input_data"))
-
 	var v GetDataRequest
 	err := json.Unmarshal([]byte(req.FormValue("input_data")), &v)
 	if err != nil {
@@ -125,13 +318,18 @@ func (b *BegetApiMock) DnsGetData(w http.ResponseWriter, req *http.Request) {
 		Status: "succsess",
 	}
 
-	b.Lock()
-	resp.Answer.Result.Records = b.txtRecords[v.FQDN]
-	b.Unlock()
-
-	if resp.Answer.Result.Records == nil {
-		resp.Answer.Result.Records = make(Records, 0)
+	b.RLock()
+	_, records, ok := b.accounts[req.FormValue("login")].records(v.FQDN)
+	if !ok {
+		b.RUnlock()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(getJsonErrorFailedToGetDnsRecords()))
+		return
 	}
+	resp.Answer.Result.FQDN = normalizeName(v.FQDN)
+	resp.Answer.Result.Records = *records
+	b.RUnlock()
+
 	resp.Answer.Status = "success"
 
 	response, err := json.Marshal(resp)
@@ -144,15 +342,98 @@ func (b *BegetApiMock) DnsGetData(w http.ResponseWriter, req *http.Request) {
 	w.Write(response)
 }
 
+func (b *BegetApiMock) DomainGetList(w http.ResponseWriter, req *http.Request) {
+	b.RLock()
+	account := b.accounts[req.FormValue("login")]
+	domains := make([]Domain, 0, len(account.domains))
+	for _, d := range account.domains {
+		domains = append(domains, d.Domain)
+	}
+	b.RUnlock()
+
+	sort.Slice(domains, func(i, j int) bool { return domains[i].ID < domains[j].ID })
+
+	writeJsonResult(w, domains)
+}
+
+func (b *BegetApiMock) DomainGetSubdomainList(w http.ResponseWriter, req *http.Request) {
+	b.RLock()
+	subdomains := make([]Subdomain, 0)
+	for _, d := range b.accounts[req.FormValue("login")].domains {
+		for _, s := range d.subdomains {
+			subdomains = append(subdomains, s.Subdomain)
+		}
+	}
+	b.RUnlock()
+
+	sort.Slice(subdomains, func(i, j int) bool { return subdomains[i].ID < subdomains[j].ID })
+
+	writeJsonResult(w, subdomains)
+}
+
+func (b *BegetApiMock) DomainAddSubdomainVirtual(w http.ResponseWriter, req *http.Request) {
+	var v struct {
+		Subdomain string `json:"subdomain"`
+		DomainID  int    `json:"domain_id"`
+	}
+	if err := json.Unmarshal([]byte(req.FormValue("input_data")), &v); err != nil || v.Subdomain == "" {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(getJsonErrorIncorrectInputData()))
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	d, ok := b.accounts[req.FormValue("login")].domains[v.DomainID]
+	if !ok {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(getJsonErrorUnknownDomain()))
+		return
+	}
+
+	fqdn := v.Subdomain + "." + d.FQDN
+	if b.hasName(fqdn) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(getJsonErrorSubdomainExists()))
+		return
+	}
+
+	writeJsonResult(w, b.addSubdomain(d, fqdn))
+}
+
+func (b *BegetApiMock) DomainDeleteSubdomain(w http.ResponseWriter, req *http.Request) {
+	var v struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(req.FormValue("input_data")), &v); err != nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(getJsonErrorIncorrectInputData()))
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	// the records of the subdomain go away with it
+	d, _, ok := b.accounts[req.FormValue("login")].subdomain(v.ID)
+	if !ok {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(getJsonErrorUnknownDomain()))
+		return
+	}
+	delete(d.subdomains, v.ID)
+	d.changed()
+
+	writeJsonResult(w, true)
+}
+
 // structs
 
 type GetDataRequest struct {
 	FQDN string `json:"fqdn"`
 }
 
-// To persist every record and every possible field in it
-type Records map[string][]map[string]interface{}
-
 type GetDataResult struct {
 	// along with other fields
 	FQDN    string  `json:"fqdn"`
@@ -166,16 +447,38 @@ type ChangeRecordsRequest struct {
 
 // helpers
 
-func (b *BegetApiMock) authMiddleware(next http.Handler) http.Handler {
+func (b *BegetApiMock) failureMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("middleware")
-		r.ParseForm()
-		if b.login != r.Form.Get("login") {
-			w.WriteHeader(http.StatusForbidden)
+		b.Lock()
+		b.calls++
+		var failure *injectedFailure
+		if len(b.failures) > 0 {
+			failure = &b.failures[0]
+			b.failures = b.failures[1:]
+		}
+		b.Unlock()
+
+		if failure != nil {
+			w.WriteHeader(failure.status)
+			w.Write([]byte(failure.body))
 			return
 		}
-		if b.passwd != r.Form.Get("passwd") {
-			w.WriteHeader(http.StatusForbidden)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (b *BegetApiMock) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// credentials come either in the query or in the multipart body
+		r.ParseMultipartForm(1 << 20)
+		b.RLock()
+		account, ok := b.accounts[r.Form.Get("login")]
+		ok = ok && account.passwd == r.Form.Get("passwd")
+		b.RUnlock()
+		if !ok {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(getJsonErrorAuth()))
 			return
 		}
 
@@ -185,10 +488,7 @@ func (b *BegetApiMock) authMiddleware(next http.Handler) http.Handler {
 
 func baseParamsCheckMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("base middleware")
-
 		r.ParseMultipartForm(1024)
-		fmt.Printf("got: %s", r.Form.Encode())
 
 		if r.Form.Has("input_format") && !oneOf[string](r.Form.Get("input_format"), []string{"plain", "json"}) {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -221,7 +521,6 @@ func baseParamsCheckMiddleware(next http.Handler) http.Handler {
 
 func changeRecordsParamsCheckMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("getData middleware")
 		r.ParseForm()
 		if r.Form.Has("input_format") && !oneOf[string](r.Form.Get("input_format"), []string{"plain", "json"}) {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -246,13 +545,18 @@ func getJsonError(status, ansStatus, ansErrCode, ansErrText string) string {
 	return fmt.Sprintf(ErrTemplate, status, ansStatus, ansErrCode, ansErrText)
 }
 
+// any method with a wrong login or password, reported on the top level
+func getJsonErrorAuth() string {
+	return `{"status":"error","error_text":"No such user or password is wrong","error_code":"AUTH_ERROR"}`
+}
+
 func getJsonErrorIncorrectInputData() string {
-	return getJsonError("success", "error", "INVALID_DATA", "\"Incorrect input\ndata\"")
+	return getJsonError("success", "error", "INVALID_DATA", "\"Incorrect input\\ndata\"")
 }
 
 // dns/getData on unkown domain name
 func getJsonErrorFailedToGetDnsRecords() string {
-	return getJsonError("success", "error", "METHOD_FAILED", "\"Failed to get DNS\nrecords\"")
+	return getJsonError("success", "error", "METHOD_FAILED", "\"Failed to get DNS\\nrecords\"")
 }
 
 // dns/changeRecords on unkown domain name
@@ -260,10 +564,40 @@ func getJsonErrorChangeUnknownDnsRecords() string {
 	return getJsonError("success", "error", "METHOD_FAILED", "{\"type\":\"NOT_FOUND_ERROR\",\"message\":null}")
 }
 
-func getJsonInvalidError() string {
-	return "Cannot parse the JSON input params"
+// domain/* on a domain or a subdomain id unknown to the account
+func getJsonErrorUnknownDomain() string {
+	return getJsonError("success", "error", "METHOD_FAILED", "{\"type\":\"NOT_FOUND_ERROR\",\"message\":null}")
 }
 
-func untrimTrimmedFqdn(fqdn string) string {
-	return fqdn + "."
+// domain/addSubdomainVirtual on an existing name
+func getJsonErrorSubdomainExists() string {
+	return getJsonError("success", "error", "METHOD_FAILED", "\"Subdomain already exists\"")
+}
+
+func writeJsonResult(w http.ResponseWriter, result interface{}) {
+	resp := struct {
+		Status string `json:"status"`
+		Answer struct {
+			Status string      `json:"status"`
+			Result interface{} `json:"result"`
+		} `json:"answer"`
+	}{
+		Status: "success",
+	}
+	resp.Answer.Status = "success"
+	resp.Answer.Result = result
+
+	response, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(501)
+		w.Write([]byte("unexpected mock error: unable to marshal"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+func getJsonInvalidError() string {
+	return "Cannot parse the JSON input params"
 }
@@ -0,0 +1,170 @@
+package begetapi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The mock keeps its state the way beget does: an account owns the domains
+// added in its panel, a domain owns its subdomains, and every domain and
+// subdomain holds the record set of its name. Names are unique across
+// accounts, a domain can't be added to two accounts. Every domain is a zone
+// of the mock DNS server, its serial grows with every change of the zone.
+
+type mockAccount struct {
+	passwd  string
+	domains map[int]*mockDomain
+}
+
+type mockDomain struct {
+	Domain
+	records    Records
+	subdomains map[int]*mockSubdomain
+	serial     uint32
+}
+
+type mockSubdomain struct {
+	Subdomain
+	records Records
+}
+
+func newMockAccount(passwd string) *mockAccount {
+	return &mockAccount{passwd: passwd, domains: make(map[int]*mockDomain)}
+}
+
+// normalizeName makes names given with a trailing dot or in other case
+// comparable to the stored ones
+func normalizeName(fqdn string) string {
+	return strings.ToLower(strings.TrimSuffix(fqdn, "."))
+}
+
+// lookup returns the record set of the domain or of one of its subdomains
+func (d *mockDomain) lookup(fqdn string) (*Records, bool) {
+	fqdn = normalizeName(fqdn)
+	if d.FQDN == fqdn {
+		return &d.records, true
+	}
+	for _, s := range d.subdomains {
+		if s.FQDN == fqdn {
+			return &s.records, true
+		}
+	}
+
+	return nil, false
+}
+
+// hasDescendants reports whether a subdomain of the domain is below the name,
+// making the name exist in DNS even without records of its own
+func (d *mockDomain) hasDescendants(fqdn string) bool {
+	suffix := "." + normalizeName(fqdn)
+	for _, s := range d.subdomains {
+		if strings.HasSuffix(s.FQDN, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// changed marks a change of the zone of the domain
+func (d *mockDomain) changed() {
+	d.serial++
+}
+
+// records returns the record set of a domain or a subdomain of the account
+// along with the domain holding it
+func (a *mockAccount) records(fqdn string) (*mockDomain, *Records, bool) {
+	for _, d := range a.domains {
+		if records, ok := d.lookup(fqdn); ok {
+			return d, records, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// subdomain returns the subdomain of one of the account's domains by its id
+func (a *mockAccount) subdomain(id int) (*mockDomain, *mockSubdomain, bool) {
+	for _, d := range a.domains {
+		if s, ok := d.subdomains[id]; ok {
+			return d, s, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+func (b *BegetApiMock) addDomain(login, fqdn string) (int, error) {
+	a, ok := b.accounts[login]
+	if !ok {
+		return 0, fmt.Errorf("no account %s", login)
+	}
+
+	fqdn = normalizeName(fqdn)
+	if b.hasName(fqdn) {
+		return 0, fmt.Errorf("%s is already added", fqdn)
+	}
+
+	b.lastID++
+	a.domains[b.lastID] = &mockDomain{
+		Domain:     Domain{ID: b.lastID, FQDN: fqdn},
+		subdomains: make(map[int]*mockSubdomain),
+		serial:     1,
+	}
+
+	return b.lastID, nil
+}
+
+func (b *BegetApiMock) addSubdomain(d *mockDomain, fqdn string) int {
+	b.lastID++
+	d.subdomains[b.lastID] = &mockSubdomain{
+		Subdomain: Subdomain{ID: b.lastID, FQDN: normalizeName(fqdn), DomainID: d.ID},
+	}
+	d.changed()
+
+	return b.lastID
+}
+
+// zoneOf returns the domain of any account holding the name, or the most
+// specific domain the name is below if no domain or subdomain is the name:
+// a subdomain stays in the zone of its domain even if a more specific domain
+// is added to another account
+func (b *BegetApiMock) zoneOf(fqdn string) (*mockDomain, bool) {
+	if d, _, ok := b.records(fqdn); ok {
+		return d, true
+	}
+
+	fqdn = normalizeName(fqdn)
+
+	var zone *mockDomain
+	for _, a := range b.accounts {
+		for _, d := range a.domains {
+			if d.FQDN != fqdn && !strings.HasSuffix(fqdn, "."+d.FQDN) {
+				continue
+			}
+			if zone == nil || len(d.FQDN) > len(zone.FQDN) {
+				zone = d
+			}
+		}
+	}
+
+	return zone, zone != nil
+}
+
+// records returns the record set of a domain or a subdomain of any account
+// along with the domain holding it
+func (b *BegetApiMock) records(fqdn string) (*mockDomain, *Records, bool) {
+	for _, a := range b.accounts {
+		if d, records, ok := a.records(fqdn); ok {
+			return d, records, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+func (b *BegetApiMock) hasName(fqdn string) bool {
+	_, _, ok := b.records(fqdn)
+
+	return ok
+}
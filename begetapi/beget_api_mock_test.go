@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"testing"
 	"time"
 
@@ -21,12 +22,15 @@ func (suite *BegetApiMockTestSuite) SetupTest() {
 	go func() {
 		suite.begetApi.Run(":8488")
 	}()
+	suite.Require().NoError(waitForServer("localhost:8488"))
 }
 
-func (suite *BegetApiMockTestSuite) TearDownSuite() {
+func (suite *BegetApiMockTestSuite) TearDownTest() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	suite.begetApi.Stop(ctx)
+	// connections kept alive to the stopped server would fail the next test
+	http.DefaultClient.CloseIdleConnections()
 }
 
 func TestBegetApiMockTestSuite(t *testing.T) {
@@ -43,3 +47,78 @@ func (suite *BegetApiMockTestSuite) TestBegetApiMock_Run() {
 	suite.Require().NoError(err, fmt.Sprintf("failed getData %s", err))
 	suite.Require().Equal(500, r.StatusCode, fmt.Sprintf("changeRecords responded %d", r.StatusCode))
 }
+
+func (suite *BegetApiMockTestSuite) TestBegetApiMock_Accounts() {
+	suite.begetApi.AddDomain("example.com")
+	suite.begetApi.AddAccount("other", "otherp")
+	_, err := suite.begetApi.AddAccountDomain("other", "example.org")
+	suite.Require().NoError(err)
+
+	_, err = suite.begetApi.AddAccountDomain("other", "example.com.")
+	suite.Require().ErrorContains(err, "example.com is already added")
+
+	u, err := url.Parse("http://localhost:8488")
+	suite.Require().NoError(err)
+	client := begetapi.NewApiClient(u, begetapi.WithRetryPolicy(begetapi.NoRetry))
+	creds := begetapi.Credentials{Login: "testl", Passwd: "testp"}
+	other := begetapi.Credentials{Login: "other", Passwd: "otherp"}
+
+	domains, err := client.GetDomainList(other)
+	suite.Require().NoError(err)
+	suite.Require().Equal([]begetapi.Domain{{ID: 2, FQDN: "example.org"}}, domains)
+
+	// names of other accounts are unknown
+	_, err = client.GetData("example.com", other)
+	suite.True(begetapi.IsNotFound(err))
+	err = client.ChangeRecords("example.com", begetapi.Records{}, other)
+	suite.True(begetapi.IsNotFound(err))
+	_, err = client.AddSubdomainVirtual("www", 1, other)
+	suite.True(begetapi.IsNotFound(err))
+
+	id, err := client.AddSubdomainVirtual("www", 1, creds)
+	suite.Require().NoError(err)
+	subdomains, err := client.GetSubdomainList(other)
+	suite.Require().NoError(err)
+	suite.Empty(subdomains)
+	suite.True(begetapi.IsNotFound(client.DeleteSubdomain(id, other)))
+}
+
+func (suite *BegetApiMockTestSuite) TestBegetApiMock_Records() {
+	suite.begetApi.AddDomain("example.com")
+	_, err := suite.begetApi.AddSubdomain("www.example.com")
+	suite.Require().NoError(err)
+
+	u, err := url.Parse("http://localhost:8488")
+	suite.Require().NoError(err)
+	client := begetapi.NewApiClient(u, begetapi.WithRetryPolicy(begetapi.NoRetry))
+	creds := begetapi.Credentials{Login: "testl", Passwd: "testp"}
+
+	records := begetapi.Records{
+		A:   []begetapi.ARecord{{Address: "192.0.2.1"}},
+		TXT: []begetapi.TXTRecord{{TXTData: "first"}, {TXTData: "second"}},
+	}
+	suite.Require().NoError(client.ChangeRecords("www.example.com", records, creds))
+
+	// a name is the same with a trailing dot and in any case
+	stored, ok := suite.begetApi.LookupRecords("WWW.example.com.")
+	suite.Require().True(ok)
+	suite.Equal(records, stored)
+
+	got, err := client.GetData("www.example.com", creds)
+	suite.Require().NoError(err)
+	suite.Equal(records, got)
+
+	_, err = client.GetData("api.example.com", creds)
+	suite.True(begetapi.IsNotFound(err))
+	err = client.ChangeRecords("api.example.com", records, creds)
+	suite.True(begetapi.IsNotFound(err))
+
+	// the records of a subdomain go away with it
+	subdomains, err := client.GetSubdomainList(creds)
+	suite.Require().NoError(err)
+	suite.Require().NoError(client.DeleteSubdomain(subdomains[0].ID, creds))
+	_, ok = suite.begetApi.LookupRecords("www.example.com")
+	suite.False(ok)
+	suite.Require().NoError(suite.begetApi.SetRecords("example.com", records))
+	suite.Require().Error(suite.begetApi.SetRecords("www.example.com", records))
+}
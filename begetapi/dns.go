@@ -2,89 +2,221 @@ package begetapi
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
 )
 
+const (
+	// mockTTL is the TTL of records stored without one, short for tests
+	mockTTL = 5
+	// maxMockCNAMEChain bounds following CNAME records within the mock's zones
+	maxMockCNAMEChain = 8
+	// mockHostmaster is the mailbox of the SOA records of the zones
+	mockHostmaster = "hostmaster.beget.com."
+)
+
+// mockNameservers are the nameservers of a zone without NS records of its own,
+// the ones beget delegates its domains to
+var mockNameservers = []string{"ns1.beget.com.", "ns2.beget.com."}
+
+// handleDNSRequest answers queries authoritatively from the records of the
+// domains of all accounts, every domain is a zone
 func (e *BegetApiMock) handleDNSRequest(w dns.ResponseWriter, req *dns.Msg) {
-	fmt.Println("\n\nHandleDNS")
 	msg := new(dns.Msg)
-	fmt.Println("\n\n>" + msg.String())
 	msg.SetReply(req)
-	switch req.Opcode {
-	case dns.OpcodeQuery:
-		for _, q := range msg.Question {
-			fmt.Println("\n\n>> for")
-			if err := e.addDNSAnswer(q, msg, req); err != nil {
-				msg.SetRcode(req, dns.RcodeServerFailure)
-				break
-			}
-		}
+
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		msg.SetRcode(req, dns.RcodeNotImplemented)
+		w.WriteMsg(msg)
+		return
+	}
+
+	e.RLock()
+	err := e.answer(msg, req.Question[0])
+	e.RUnlock()
+	if err != nil {
+		klog.V(2).Infof("mock dns: answering %s: %v", req.Question[0].String(), err)
+		msg.Answer, msg.Ns = nil, nil
+		msg.SetRcode(req, dns.RcodeServerFailure)
 	}
+
 	w.WriteMsg(msg)
 }
 
-func (e *BegetApiMock) addDNSAnswer(q dns.Question, msg *dns.Msg, req *dns.Msg) error {
-	switch q.Qtype {
-	// Always return loopback for any A query
-	case dns.TypeA:
-		rr, err := dns.NewRR(fmt.Sprintf("%s 5 IN A 127.0.0.1", q.Name))
-		if err != nil {
-			return err
-		}
-		msg.Answer = append(msg.Answer, rr)
+// answer fills the reply to the question, names out of the zones are refused
+func (e *BegetApiMock) answer(msg *dns.Msg, q dns.Question) error {
+	zone, ok := e.zoneOf(q.Name)
+	if !ok {
+		msg.Rcode = dns.RcodeRefused
 		return nil
+	}
+	msg.Authoritative = true
 
-	// TXT records are the only important record for ACME dns-01 challenges
-	case dns.TypeTXT:
-		fmt.Println("\n\n>> TypeTXT: " + q.Name)
-		e.RLock()
-		records, found := e.txtRecords[q.Name]
-		e.RUnlock()
-		if !found {
-			fmt.Println("\n\n>> !FOUND")
-			msg.SetRcode(req, dns.RcodeNameError)
-			return nil
-		}
-		_, ok := records[TXTKey]
-		if !ok || len(records[TXTKey]) == 0 {
-			fmt.Println("\n\n>> !ok record")
-			msg.SetRcode(req, dns.RcodeNameError)
-			return nil
-		}
-		record, ok := records[TXTKey][0][TXTDataKey].(string)
+	name := q.Name
+	for i := 0; i < maxMockCNAMEChain; i++ {
+		records, ok := zone.lookup(name)
 		if !ok {
-			fmt.Println("\n\n>> !ok record")
-			msg.SetRcode(req, dns.RcodeNameError)
+			// a name with subdomains below exists, it just has no records
+			if !zone.hasDescendants(name) {
+				msg.Rcode = dns.RcodeNameError
+			}
+			msg.Ns = append(msg.Ns, zone.soa())
 			return nil
 		}
 
-		fmt.Println("\n\n>> FOUND: " + fmt.Sprintf("%s 5 IN TXT %s", q.Name, record))
-		rr, err := dns.NewRR(fmt.Sprintf("%s 5 IN TXT %s", q.Name, record))
+		// an alias stands for all types of records of its name
+		if len(records.CNAME) > 0 && q.Qtype != dns.TypeCNAME {
+			target := dns.Fqdn(records.CNAME[0].CNAME)
+			msg.Answer = append(msg.Answer, &dns.CNAME{
+				Hdr:    header(name, dns.TypeCNAME, records.CNAME[0].TTL),
+				Target: target,
+			})
+
+			// the resolver follows aliases to names out of the zones itself
+			if zone, ok = e.zoneOf(target); !ok {
+				return nil
+			}
+			name = target
+			continue
+		}
+
+		rrs, err := zone.rrs(name, *records, q.Qtype)
 		if err != nil {
-			fmt.Println("\n\n>> rrErr " + err.Error())
 			return err
 		}
-		fmt.Println("\n\n>> answer")
-		msg.Answer = append(msg.Answer, rr)
+		if len(rrs) == 0 {
+			msg.Ns = append(msg.Ns, zone.soa())
+		}
+		msg.Answer = append(msg.Answer, rrs...)
+
 		return nil
+	}
 
-	// NS and SOA are for authoritative lookups, return obviously invalid data
+	return fmt.Errorf("CNAME chain of %s is longer than %d", q.Name, maxMockCNAMEChain)
+}
+
+// rrs converts the records of the name of the type to resource records
+func (d *mockDomain) rrs(name string, records Records, qtype uint16) ([]dns.RR, error) {
+	var rrs []dns.RR
+
+	switch qtype {
+	case dns.TypeA:
+		for _, r := range records.A {
+			ip := net.ParseIP(r.Address).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid A record %q of %s", r.Address, name)
+			}
+			rrs = append(rrs, &dns.A{Hdr: header(name, qtype, r.TTL), A: ip})
+		}
+	case dns.TypeAAAA:
+		for _, r := range records.AAAA {
+			ip := net.ParseIP(r.Address)
+			if ip == nil || ip.To4() != nil {
+				return nil, fmt.Errorf("invalid AAAA record %q of %s", r.Address, name)
+			}
+			rrs = append(rrs, &dns.AAAA{Hdr: header(name, qtype, r.TTL), AAAA: ip})
+		}
+	case dns.TypeCNAME:
+		for _, r := range records.CNAME {
+			rrs = append(rrs, &dns.CNAME{Hdr: header(name, qtype, r.TTL), Target: dns.Fqdn(r.CNAME)})
+		}
+	case dns.TypeMX:
+		for _, r := range records.MX {
+			rrs = append(rrs, &dns.MX{Hdr: header(name, qtype, r.TTL), Preference: uint16(r.Preference), Mx: dns.Fqdn(r.Exchange)})
+		}
+	case dns.TypeTXT:
+		for _, r := range records.TXT {
+			rrs = append(rrs, &dns.TXT{Hdr: header(name, qtype, r.TTL), Txt: splitTXT(r.TXTData)})
+		}
 	case dns.TypeNS:
-		rr, err := dns.NewRR(fmt.Sprintf("%s 5 IN NS ns.example-acme-webook.invalid.", q.Name))
-		if err != nil {
-			return err
+		for _, r := range records.NS {
+			rrs = append(rrs, &dns.NS{Hdr: header(name, qtype, r.TTL), Ns: dns.Fqdn(r.NSDName)})
+		}
+		if len(rrs) == 0 && d.isApex(name) {
+			for _, ns := range d.nameservers() {
+				rrs = append(rrs, &dns.NS{Hdr: header(name, qtype, nil), Ns: ns})
+			}
 		}
-		msg.Answer = append(msg.Answer, rr)
-		return nil
 	case dns.TypeSOA:
-		rr, err := dns.NewRR(fmt.Sprintf("%s 5 IN SOA %s 20 5 5 5 5", "ns.example-acme-webook.invalid.", "ns.example-acme-webook.invalid."))
-		if err != nil {
-			return err
+		if d.isApex(name) {
+			rrs = append(rrs, d.soa())
+		}
+	case dns.TypeCAA:
+		for _, r := range records.CAA {
+			rrs = append(rrs, &dns.CAA{Hdr: header(name, qtype, r.TTL), Flag: uint8(r.Flags), Tag: r.Tag, Value: r.Value})
+		}
+	case dns.TypeSRV:
+		for _, r := range records.SRV {
+			rrs = append(rrs, &dns.SRV{
+				Hdr:      header(name, qtype, r.TTL),
+				Priority: uint16(r.Priority),
+				Weight:   uint16(r.Weight),
+				Port:     uint16(r.Port),
+				Target:   dns.Fqdn(r.Target),
+			})
 		}
-		msg.Answer = append(msg.Answer, rr)
-		return nil
-	default:
-		return fmt.Errorf("unimplemented record type %v", q.Qtype)
 	}
+
+	return rrs, nil
+}
+
+func (d *mockDomain) isApex(name string) bool {
+	return normalizeName(name) == d.FQDN
+}
+
+// nameservers returns the NS records of the domain, or beget's ones
+func (d *mockDomain) nameservers() []string {
+	if len(d.records.NS) == 0 {
+		return mockNameservers
+	}
+
+	nameservers := make([]string, 0, len(d.records.NS))
+	for _, r := range d.records.NS {
+		nameservers = append(nameservers, dns.Fqdn(r.NSDName))
+	}
+
+	return nameservers
+}
+
+// soa returns the SOA record of the zone of the domain, its serial counts the
+// changes of the zone
+func (d *mockDomain) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     header(d.FQDN, dns.TypeSOA, nil),
+		Ns:      d.nameservers()[0],
+		Mbox:    mockHostmaster,
+		Serial:  d.serial,
+		Refresh: 300,
+		Retry:   60,
+		Expire:  86400,
+		Minttl:  mockTTL,
+	}
+}
+
+// header returns the header of a record, one stored without a TTL gets mockTTL
+func header(name string, rrtype uint16, ttl *int) dns.RR_Header {
+	seconds := mockTTL
+	if ttl != nil && *ttl >= 0 {
+		seconds = *ttl
+	}
+
+	return dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrtype, Class: dns.ClassINET, Ttl: uint32(seconds)}
+}
+
+// splitTXT splits a value into the character strings of a TXT record, each
+// of them is at most 255 bytes long
+func splitTXT(value string) []string {
+	if value == "" {
+		return []string{""}
+	}
+
+	var chunks []string
+	for len(value) > 255 {
+		chunks = append(chunks, value[:255])
+		value = value[255:]
+	}
+
+	return append(chunks, value)
 }
@@ -0,0 +1,197 @@
+package begetapi_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBegetApiMock_DNS(t *testing.T) {
+	mock := begetapi.NewBegetApiMock("login", "password")
+	mock.AddDomain("example.com")
+	for _, name := range []string{"www.example.com", "_acme-challenge.www.example.com", "alias.example.com", "_sip._tcp.example.com"} {
+		_, err := mock.AddSubdomain(name)
+		require.NoError(t, err)
+	}
+
+	long := strings.Repeat("x", 300)
+	require.NoError(t, mock.SetRecords("example.com", begetapi.Records{
+		A:    []begetapi.ARecord{{Address: "192.0.2.1", TTL: begetapi.TTL(600)}},
+		AAAA: []begetapi.AAAARecord{{Address: "2001:db8::1"}},
+		MX:   []begetapi.MXRecord{{Exchange: "mail.example.com", Preference: 10}},
+		CAA:  []begetapi.CAARecord{{Tag: "issue", Value: "letsencrypt.org"}},
+	}))
+	require.NoError(t, mock.SetRecords("_acme-challenge.www.example.com", begetapi.Records{
+		TXT: []begetapi.TXTRecord{{TXTData: "first"}, {TXTData: "second"}, {TXTData: long}},
+	}))
+	require.NoError(t, mock.SetRecords("alias.example.com", begetapi.Records{
+		CNAME: []begetapi.CNAMERecord{{CNAME: "example.com"}},
+	}))
+	require.NoError(t, mock.SetRecords("_sip._tcp.example.com", begetapi.Records{
+		SRV: []begetapi.SRVRecord{{Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com"}},
+	}))
+
+	addr := serveTestDNS(t, mock)
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+
+		var in *dns.Msg
+		var err error
+		for i := 0; i < 50; i++ {
+			if in, err = dns.Exchange(msg, addr); err == nil {
+				return in
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		require.NoError(t, err)
+
+		return nil
+	}
+	answers := func(in *dns.Msg) []string {
+		var rrs []string
+		for _, rr := range in.Answer {
+			rrs = append(rrs, rr.String())
+		}
+
+		return rrs
+	}
+
+	in := query("example.com.", dns.TypeA)
+	require.True(t, in.Authoritative)
+	require.Equal(t, []string{"example.com.\t600\tIN\tA\t192.0.2.1"}, answers(in))
+
+	require.Equal(t, []string{"example.com.\t5\tIN\tAAAA\t2001:db8::1"}, answers(query("example.com.", dns.TypeAAAA)))
+	require.Equal(t, []string{"example.com.\t5\tIN\tMX\t10 mail.example.com."}, answers(query("example.com.", dns.TypeMX)))
+	require.Equal(t, []string{"example.com.\t5\tIN\tCAA\t0 issue \"letsencrypt.org\""}, answers(query("example.com.", dns.TypeCAA)))
+	require.Equal(t, []string{"_sip._tcp.example.com.\t5\tIN\tSRV\t10 5 5060 sip.example.com."}, answers(query("_sip._tcp.example.com.", dns.TypeSRV)))
+	require.Equal(t, []string{"example.com.\t5\tIN\tNS\tns1.beget.com.", "example.com.\t5\tIN\tNS\tns2.beget.com."}, answers(query("example.com.", dns.TypeNS)))
+
+	// every TXT value is served, long ones split into character strings
+	in = query("_acme-challenge.www.example.com.", dns.TypeTXT)
+	require.Len(t, in.Answer, 3)
+	require.Equal(t, []string{"first"}, in.Answer[0].(*dns.TXT).Txt)
+	require.Equal(t, []string{"second"}, in.Answer[1].(*dns.TXT).Txt)
+	require.Equal(t, []string{long[:255], long[255:]}, in.Answer[2].(*dns.TXT).Txt)
+
+	// aliases are followed within the zones, and answered as such on CNAME queries
+	require.Equal(t, []string{
+		"alias.example.com.\t5\tIN\tCNAME\texample.com.",
+		"example.com.\t600\tIN\tA\t192.0.2.1",
+	}, answers(query("alias.example.com.", dns.TypeA)))
+	require.Equal(t, []string{"alias.example.com.\t5\tIN\tCNAME\texample.com."}, answers(query("alias.example.com.", dns.TypeCNAME)))
+
+	// a name without records of the type has no data
+	in = query("www.example.com.", dns.TypeTXT)
+	require.Equal(t, dns.RcodeSuccess, in.Rcode)
+	require.Empty(t, in.Answer)
+	require.IsType(t, &dns.SOA{}, in.Ns[0])
+
+	// a name with subdomains below exists too
+	in = query("_tcp.example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, in.Rcode)
+	require.Empty(t, in.Answer)
+
+	in = query("unknown.example.com.", dns.TypeTXT)
+	require.Equal(t, dns.RcodeNameError, in.Rcode)
+	require.True(t, in.Authoritative)
+	soa := in.Ns[0].(*dns.SOA)
+	require.Equal(t, "example.com.", soa.Hdr.Name)
+	require.Equal(t, "ns1.beget.com.", soa.Ns)
+
+	// names of no zone of the mock are refused
+	in = query("example.org.", dns.TypeA)
+	require.Equal(t, dns.RcodeRefused, in.Rcode)
+	require.False(t, in.Authoritative)
+
+	// every change of the zone increments the serial
+	serial := query("example.com.", dns.TypeSOA).Answer[0].(*dns.SOA).Serial
+	require.NoError(t, mock.SetRecords("www.example.com", begetapi.Records{TXT: []begetapi.TXTRecord{{TXTData: "new"}}}))
+	require.Equal(t, serial+1, query("example.com.", dns.TypeSOA).Answer[0].(*dns.SOA).Serial)
+	require.Equal(t, []string{"www.example.com.\t5\tIN\tTXT\t\"new\""}, answers(query("www.example.com.", dns.TypeTXT)))
+}
+
+func TestBegetApiMock_DNS_NestedDomainOfOtherAccount(t *testing.T) {
+	mock := begetapi.NewBegetApiMock("login", "password")
+	mock.AddDomain("example.com")
+	_, err := mock.AddSubdomain("www.sub.example.com")
+	require.NoError(t, err)
+	require.NoError(t, mock.SetRecords("www.sub.example.com", begetapi.Records{
+		A: []begetapi.ARecord{{Address: "192.0.2.1"}},
+	}))
+
+	// a more specific domain added later doesn't take the subdomain over
+	mock.AddAccount("other", "password")
+	_, err = mock.AddAccountDomain("other", "sub.example.com")
+	require.NoError(t, err)
+
+	addr := serveTestDNS(t, mock)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.sub.example.com.", dns.TypeA)
+
+	var in *dns.Msg
+	for i := 0; i < 50; i++ {
+		if in, err = dns.Exchange(msg, addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, in.Rcode)
+	require.Len(t, in.Answer, 1)
+	require.Equal(t, "www.sub.example.com.\t5\tIN\tA\t192.0.2.1", in.Answer[0].String())
+
+	// names of neither are in the zone of the more specific domain
+	msg.SetQuestion("unknown.sub.example.com.", dns.TypeA)
+	in, err = dns.Exchange(msg, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, in.Rcode)
+	require.Equal(t, "sub.example.com.", in.Ns[0].Header().Name)
+}
+
+func TestBegetApiMock_RunDns_AddressInUse(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	mock := begetapi.NewBegetApiMock("login", "password")
+	require.Error(t, mock.RunDnsAddr(addr))
+
+	// the failed start leaves the mock stopped, it may be started again
+	conn.Close()
+	served := make(chan error, 1)
+	go func() { served <- mock.RunDnsAddr(addr) }()
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	require.Eventually(t, func() bool {
+		_, err := dns.Exchange(msg, addr)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, mock.StopDns(context.TODO()))
+	require.NoError(t, <-served)
+}
+
+// serveTestDNS serves the DNS records of the mock on a free port until the
+// test ends and returns its address
+func serveTestDNS(t *testing.T, mock *begetapi.BegetApiMock) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go mock.ServeDns(conn)
+	t.Cleanup(func() { mock.StopDns(context.TODO()) })
+
+	return conn.LocalAddr().String()
+}
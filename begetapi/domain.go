@@ -0,0 +1,128 @@
+package begetapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Domain is a domain added to the account in beget's panel
+type Domain struct {
+	ID   int    `json:"id"`
+	FQDN string `json:"fqdn"`
+}
+
+// Subdomain is a subdomain of one of the account's domains
+type Subdomain struct {
+	ID       int    `json:"id"`
+	FQDN     string `json:"fqdn"`
+	DomainID int    `json:"domain_id"`
+}
+
+func (a *ApiClient) GetDomainList(credentials Credentials) ([]Domain, error) {
+	return a.GetDomainListContext(context.Background(), credentials)
+}
+
+func (a *ApiClient) GetDomainListContext(ctx context.Context, credentials Credentials) ([]Domain, error) {
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+
+	var domains []Domain
+	if err := a.callResult(ctx, "domain/getList", struct{}{}, credentials, &domains); err != nil {
+		return nil, err
+	}
+
+	return domains, nil
+}
+
+func (a *ApiClient) GetSubdomainList(credentials Credentials) ([]Subdomain, error) {
+	return a.GetSubdomainListContext(context.Background(), credentials)
+}
+
+func (a *ApiClient) GetSubdomainListContext(ctx context.Context, credentials Credentials) ([]Subdomain, error) {
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+
+	var subdomains []Subdomain
+	if err := a.callResult(ctx, "domain/getSubdomainList", struct{}{}, credentials, &subdomains); err != nil {
+		return nil, err
+	}
+
+	return subdomains, nil
+}
+
+// AddSubdomainVirtual adds the subdomain, given without its domain, to the domain
+// and returns the id of the new subdomain
+func (a *ApiClient) AddSubdomainVirtual(subdomain string, domainID int, credentials Credentials) (int, error) {
+	return a.AddSubdomainVirtualContext(context.Background(), subdomain, domainID, credentials)
+}
+
+func (a *ApiClient) AddSubdomainVirtualContext(ctx context.Context, subdomain string, domainID int, credentials Credentials) (int, error) {
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+
+	values := struct {
+		Subdomain string `json:"subdomain"`
+		DomainID  int    `json:"domain_id"`
+	}{
+		Subdomain: subdomain,
+		DomainID:  domainID,
+	}
+
+	var id int
+	if err := a.callResult(ctx, "domain/addSubdomainVirtual", values, credentials, &id); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (a *ApiClient) DeleteSubdomain(id int, credentials Credentials) error {
+	return a.DeleteSubdomainContext(context.Background(), id, credentials)
+}
+
+func (a *ApiClient) DeleteSubdomainContext(ctx context.Context, id int, credentials Credentials) error {
+	ctx, cancel := a.withTimeout(ctx)
+	defer cancel()
+
+	values := struct {
+		ID int `json:"id"`
+	}{
+		ID: id,
+	}
+
+	var result bool
+	if err := a.callResult(ctx, "domain/deleteSubdomain", values, credentials, &result); err != nil {
+		return err
+	}
+
+	if !result {
+		return fmt.Errorf("subdomain %d is not deleted", id)
+	}
+
+	return nil
+}
+
+// callResult calls the API method and decodes answer.result of the response into result
+func (a *ApiClient) callResult(ctx context.Context, method string, input interface{}, credentials Credentials, result interface{}) error {
+	bdy, err := a.call(ctx, method, input, credentials)
+	if err != nil {
+		return err
+	}
+
+	var rsp struct {
+		Answer struct {
+			Result json.RawMessage `json:"result"`
+		} `json:"answer"`
+	}
+
+	if err := json.Unmarshal(bdy, &rsp); err != nil {
+		return fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	if err := json.Unmarshal(rsp.Answer.Result, result); err != nil {
+		return fmt.Errorf("unmarshal result of %s: %w", method, err)
+	}
+
+	return nil
+}
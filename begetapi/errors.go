@@ -0,0 +1,188 @@
+package begetapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	ErrorCodeAuth         = "AUTH_ERROR"
+	ErrorCodeLimit        = "LIMIT_ERROR"
+	ErrorCodeMethodFailed = "METHOD_FAILED"
+	ErrorCodeInvalidData  = "INVALID_DATA"
+	// ErrorCodeResultFalse isn't sent by the API, it marks an answer with a
+	// false result and no errors of its own
+	ErrorCodeResultFalse = "RESULT_FALSE"
+)
+
+// APIError is a response the API refused to serve: a non 200 status or
+// a status=error either on the top level (e.g. authentication) or in the answer
+type APIError struct {
+	// HTTPStatus is set for non 200 responses only
+	HTTPStatus   int
+	Status       string
+	AnswerStatus string
+	Errors       []ErrorEntry
+	Body         []byte
+}
+
+// ErrorEntry is an error_code/error_text pair of a response
+type ErrorEntry struct {
+	Code string
+	// Text is the error_text as is when it's a string, or the raw JSON otherwise
+	Text string
+}
+
+func (e *APIError) Error() string {
+	if e.HTTPStatus != 0 {
+		return fmt.Sprintf("non 200 response: %d %s", e.HTTPStatus, e.Body)
+	}
+
+	entries := make([]string, 0, len(e.Errors))
+	for _, entry := range e.Errors {
+		entries = append(entries, fmt.Sprintf("%s: %s", entry.Code, entry.Text))
+	}
+
+	return fmt.Sprintf("got error status in response: status %q, answer status %q, errors: [%s]",
+		e.Status, e.AnswerStatus, strings.Join(entries, "; "))
+}
+
+// HasCode reports whether any error entry carries the code
+func (e *APIError) HasCode(code string) bool {
+	for _, entry := range e.Errors {
+		if entry.Code == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsNotFound reports whether the API doesn't know the requested name
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	for _, entry := range apiErr.Errors {
+		if strings.Contains(entry.Text, "NOT_FOUND_ERROR") {
+			return true
+		}
+		// dns/getData on a name unknown to the panel
+		if entry.Code == ErrorCodeMethodFailed && strings.Contains(entry.Text, "Failed to get DNS") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsAuthFailed reports whether the API rejected the credentials
+func IsAuthFailed(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	return apiErr.HTTPStatus == http.StatusUnauthorized ||
+		apiErr.HTTPStatus == http.StatusForbidden ||
+		apiErr.HasCode(ErrorCodeAuth)
+}
+
+// RateLimitError is a call given up before it was made, waiting for the rate
+// limit of the account would exceed its context
+type RateLimitError struct {
+	Method string
+	Err    error
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("waiting for the rate limit of %s: %v", e.Method, e.Err)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// IsRateLimited reports whether the API rejected the call over the account's
+// request limit, or the client gave it up waiting for the limit
+func IsRateLimited(err error) bool {
+	var limitErr *RateLimitError
+	if errors.As(err, &limitErr) {
+		return true
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	return apiErr.HTTPStatus == http.StatusTooManyRequests || apiErr.HasCode(ErrorCodeLimit)
+}
+
+// parseAPIError returns an APIError for a response rejected by the API, nil otherwise
+func parseAPIError(bdy []byte) *APIError {
+	apiErr, ok := decodeAPIError(bdy)
+	if !ok || (apiErr.Status != "error" && apiErr.AnswerStatus != "error") {
+		return nil
+	}
+
+	return apiErr
+}
+
+// resultFalseError returns the error of a successful answer with a false
+// result, carrying the errors of the answer if there are any
+func resultFalseError(bdy []byte, rejected string) *APIError {
+	apiErr, _ := decodeAPIError(bdy)
+	if len(apiErr.Errors) == 0 {
+		apiErr.Errors = []ErrorEntry{{Code: ErrorCodeResultFalse, Text: fmt.Sprintf("%s, response: %s", rejected, bdy)}}
+	}
+
+	return apiErr
+}
+
+// decodeAPIError reads the statuses and the errors of the response
+func decodeAPIError(bdy []byte) (*APIError, bool) {
+	var rsp struct {
+		Status    string          `json:"status"`
+		ErrorCode string          `json:"error_code"`
+		ErrorText json.RawMessage `json:"error_text"`
+		Answer    struct {
+			Status string `json:"status"`
+			Errors []struct {
+				ErrorCode string          `json:"error_code"`
+				ErrorText json.RawMessage `json:"error_text"`
+			} `json:"errors"`
+		} `json:"answer"`
+	}
+
+	// the caller reports malformed responses
+	err := json.Unmarshal(bdy, &rsp)
+
+	apiErr := &APIError{
+		Status:       rsp.Status,
+		AnswerStatus: rsp.Answer.Status,
+		Body:         bdy,
+	}
+	if rsp.ErrorCode != "" {
+		apiErr.Errors = append(apiErr.Errors, ErrorEntry{Code: rsp.ErrorCode, Text: errorText(rsp.ErrorText)})
+	}
+	for _, e := range rsp.Answer.Errors {
+		apiErr.Errors = append(apiErr.Errors, ErrorEntry{Code: e.ErrorCode, Text: errorText(e.ErrorText)})
+	}
+
+	return apiErr, err == nil
+}
+
+func errorText(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+
+	return string(raw)
+}
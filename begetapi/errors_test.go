@@ -0,0 +1,56 @@
+package begetapi_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIError_Sentinels(t *testing.T) {
+	notFound := &begetapi.APIError{
+		Status:       "success",
+		AnswerStatus: "error",
+		Errors:       []begetapi.ErrorEntry{{Code: "METHOD_FAILED", Text: `{"type":"NOT_FOUND_ERROR","message":null}`}},
+	}
+	getDataFailed := &begetapi.APIError{
+		Status:       "success",
+		AnswerStatus: "error",
+		Errors:       []begetapi.ErrorEntry{{Code: "METHOD_FAILED", Text: "Failed to get DNS\nrecords"}},
+	}
+	auth := &begetapi.APIError{Status: "error", Errors: []begetapi.ErrorEntry{{Code: "AUTH_ERROR", Text: "No such user"}}}
+	limit := &begetapi.APIError{Status: "success", AnswerStatus: "error", Errors: []begetapi.ErrorEntry{{Code: "LIMIT_ERROR"}}}
+
+	for _, tc := range []struct {
+		err                           error
+		notFound, authFailed, limited bool
+	}{
+		{err: notFound, notFound: true},
+		{err: getDataFailed, notFound: true},
+		{err: fmt.Errorf("wrapped: %w", auth), authFailed: true},
+		{err: &begetapi.APIError{HTTPStatus: http.StatusForbidden}, authFailed: true},
+		{err: limit, limited: true},
+		{err: &begetapi.APIError{HTTPStatus: http.StatusTooManyRequests}, limited: true},
+		{err: fmt.Errorf("wrapped: %w", &begetapi.RateLimitError{Method: "dns/getData", Err: context.DeadlineExceeded}), limited: true},
+		{err: &begetapi.APIError{HTTPStatus: http.StatusBadGateway}},
+		{err: errors.New("plain")},
+	} {
+		assert.Equal(t, tc.notFound, begetapi.IsNotFound(tc.err), tc.err.Error())
+		assert.Equal(t, tc.authFailed, begetapi.IsAuthFailed(tc.err), tc.err.Error())
+		assert.Equal(t, tc.limited, begetapi.IsRateLimited(tc.err), tc.err.Error())
+	}
+}
+
+func TestAPIError_Error(t *testing.T) {
+	err := &begetapi.APIError{
+		Status:       "success",
+		AnswerStatus: "error",
+		Errors:       []begetapi.ErrorEntry{{Code: "INVALID_DATA", Text: "Incorrect input data"}},
+	}
+
+	assert.Equal(t, `got error status in response: status "success", answer status "error", errors: [INVALID_DATA: Incorrect input data]`, err.Error())
+}
@@ -0,0 +1,24 @@
+package begetapi
+
+import "time"
+
+// Observer is notified of the requests the client makes, e.g. to export metrics
+type Observer interface {
+	// ObserveRequest is called after every HTTP request to the API method,
+	// a retried call is observed once per attempt
+	ObserveRequest(method string, duration time.Duration, err error)
+	// ObserveRetry is called before the method is attempted again after
+	// the given attempt failed with err
+	ObserveRetry(method string, attempt int, err error)
+	// ObserveRateLimitWait is called after a request of the method has waited
+	// for the rate limit of its account, if the client limits the rate
+	ObserveRateLimitWait(method string, wait time.Duration)
+}
+
+type noopObserver struct{}
+
+func (noopObserver) ObserveRequest(string, time.Duration, error) {}
+
+func (noopObserver) ObserveRetry(string, int, error) {}
+
+func (noopObserver) ObserveRateLimitWait(string, time.Duration) {}
@@ -0,0 +1,75 @@
+package begetapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// accountLimiter spreads the requests of every account over time, beget
+// limits the request rate per account and rejects the excess with LIMIT_ERROR
+type accountLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newAccountLimiter(limit rate.Limit, burst int) *accountLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &accountLimiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// Wait blocks until the account may make a request or ctx is done
+func (l *accountLimiter) Wait(ctx context.Context, login string) error {
+	l.mu.Lock()
+	limiter, ok := l.limiters[login]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[login] = limiter
+	}
+	l.mu.Unlock()
+
+	return limiter.Wait(ctx)
+}
+
+// WithRateLimit limits the requests of every account, by login, to limit per
+// second with bursts of up to burst requests; callers over the limit are queued
+// until their context is done. Zero limit disables limiting
+func WithRateLimit(limit float64, burst int) Option {
+	return func(a *ApiClient) {
+		if limit <= 0 {
+			a.limiter = nil
+
+			return
+		}
+
+		a.limiter = newAccountLimiter(rate.Limit(limit), burst)
+	}
+}
+
+// waitForRateLimit queues the request of the account behind its earlier requests
+func (a *ApiClient) waitForRateLimit(ctx context.Context, method, login string) error {
+	if a.limiter == nil {
+		return nil
+	}
+
+	start := time.Now()
+	err := a.limiter.Wait(ctx, login)
+	a.observer.ObserveRateLimitWait(method, time.Since(start))
+	if err != nil {
+		return &RateLimitError{Method: method, Err: err}
+	}
+
+	return nil
+}
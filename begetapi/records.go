@@ -0,0 +1,299 @@
+package begetapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	AKey     = "A"
+	AAAAKey  = "AAAA"
+	MXKey    = "MX"
+	TXTKey   = "TXT"
+	CNAMEKey = "CNAME"
+	NSKey    = "NS"
+	SRVKey   = "SRV"
+	CAAKey   = "CAA"
+)
+
+const TXTDataKey = "txtdata"
+
+// Records is the record set of a single name, as dns/getData returns it and
+// dns/changeRecords expects it back. Record kinds and fields the package
+// doesn't model are kept, so a read-modify-write cycle doesn't lose them:
+// the fields of a record are kept in its Extra, and a TTL is nil if the
+// record comes without one, so an explicit zero is written back as such.
+type Records struct {
+	A     []ARecord
+	AAAA  []AAAARecord
+	MX    []MXRecord
+	TXT   []TXTRecord
+	CNAME []CNAMERecord
+	NS    []NSRecord
+	SRV   []SRVRecord
+	CAA   []CAARecord
+
+	// Other holds record kinds not listed above, keyed by kind
+	Other map[string]json.RawMessage
+}
+
+type ARecord struct {
+	TTL     *int   `json:"ttl,omitempty"`
+	Address string `json:"address"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type AAAARecord struct {
+	TTL     *int   `json:"ttl,omitempty"`
+	Address string `json:"address"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type MXRecord struct {
+	TTL        *int   `json:"ttl,omitempty"`
+	Exchange   string `json:"exchange"`
+	Preference int    `json:"preference"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type TXTRecord struct {
+	TTL     *int   `json:"ttl,omitempty"`
+	TXTData string `json:"txtdata"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type CNAMERecord struct {
+	TTL   *int   `json:"ttl,omitempty"`
+	CNAME string `json:"cname"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type NSRecord struct {
+	TTL     *int   `json:"ttl,omitempty"`
+	NSDName string `json:"nsdname"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type SRVRecord struct {
+	TTL      *int   `json:"ttl,omitempty"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Port     int    `json:"port"`
+	Target   string `json:"target"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type CAARecord struct {
+	TTL   *int   `json:"ttl,omitempty"`
+	Flags int    `json:"flags"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// IsEmpty reports whether the set holds no records of any kind
+func (r Records) IsEmpty() bool {
+	return len(r.A) == 0 && len(r.AAAA) == 0 && len(r.MX) == 0 && len(r.TXT) == 0 &&
+		len(r.CNAME) == 0 && len(r.NS) == 0 && len(r.SRV) == 0 && len(r.CAA) == 0 &&
+		len(r.Other) == 0
+}
+
+// kinds returns the modelled record kinds of the set, each is a pointer to
+// a slice of a record type with an Extra field
+func (r *Records) kinds() map[string]interface{} {
+	return map[string]interface{}{
+		AKey:     &r.A,
+		AAAAKey:  &r.AAAA,
+		MXKey:    &r.MX,
+		TXTKey:   &r.TXT,
+		CNAMEKey: &r.CNAME,
+		NSKey:    &r.NS,
+		SRVKey:   &r.SRV,
+		CAAKey:   &r.CAA,
+	}
+}
+
+func (r Records) MarshalJSON() ([]byte, error) {
+	kinds := make(map[string]json.RawMessage, len(r.Other)+8)
+	for k, v := range r.Other {
+		kinds[k] = v
+	}
+
+	for k, v := range r.kinds() {
+		records := reflect.ValueOf(v).Elem()
+		if records.Len() == 0 {
+			continue
+		}
+
+		data, err := marshalRecords(records)
+		if err != nil {
+			return nil, err
+		}
+		kinds[k] = data
+	}
+
+	return json.Marshal(kinds)
+}
+
+func (r *Records) UnmarshalJSON(data []byte) error {
+	*r = Records{}
+
+	// an empty set comes as [] from the API
+	trimmed := bytes.TrimSpace(data)
+	if bytes.Equal(trimmed, []byte("null")) || bytes.Equal(trimmed, []byte("[]")) {
+		return nil
+	}
+
+	var kinds map[string]json.RawMessage
+	if err := json.Unmarshal(data, &kinds); err != nil {
+		return err
+	}
+
+	modelled := r.kinds()
+	for k, v := range kinds {
+		records, ok := modelled[k]
+		if !ok {
+			if r.Other == nil {
+				r.Other = make(map[string]json.RawMessage)
+			}
+			r.Other[k] = v
+
+			continue
+		}
+
+		if err := unmarshalRecords(v, reflect.ValueOf(records).Elem()); err != nil {
+			return fmt.Errorf("%s records: %w", k, err)
+		}
+	}
+
+	return nil
+}
+
+// TTL returns the TTL of a record in seconds, for the literals of the records
+func TTL(seconds int) *int {
+	return &seconds
+}
+
+func PushTXTRecord(r *Records, txtData string) error {
+	for _, txt := range r.TXT {
+		if txt.TXTData == txtData {
+			return nil
+		}
+	}
+
+	r.TXT = append(r.TXT, TXTRecord{TXTData: txtData})
+
+	return nil
+}
+
+func PopTXTRecordByValue(r *Records, txtData string) int {
+	deleted := 0
+	kept := r.TXT[:0]
+	for _, txt := range r.TXT {
+		if txt.TXTData == txtData {
+			deleted++
+
+			continue
+		}
+
+		kept = append(kept, txt)
+	}
+
+	r.TXT = kept
+
+	return deleted
+}
+
+// marshalRecords encodes a slice of records, each along with the fields it
+// was decoded with but doesn't model
+func marshalRecords(records reflect.Value) (json.RawMessage, error) {
+	items := make([]json.RawMessage, records.Len())
+	for i := range items {
+		record := records.Index(i)
+
+		data, err := json.Marshal(record.Interface())
+		if err != nil {
+			return nil, err
+		}
+
+		extra := record.FieldByName("Extra").Interface().(map[string]json.RawMessage)
+		if len(extra) > 0 {
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(data, &fields); err != nil {
+				return nil, err
+			}
+
+			for k, v := range extra {
+				if _, ok := fields[k]; !ok {
+					fields[k] = v
+				}
+			}
+
+			if data, err = json.Marshal(fields); err != nil {
+				return nil, err
+			}
+		}
+
+		items[i] = data
+	}
+
+	return json.Marshal(items)
+}
+
+// unmarshalRecords decodes a slice of records, the fields a record type
+// doesn't model are kept in the Extra of the record
+func unmarshalRecords(data []byte, records reflect.Value) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	if items == nil {
+		records.Set(reflect.Zero(records.Type()))
+
+		return nil
+	}
+
+	decoded := reflect.MakeSlice(records.Type(), len(items), len(items))
+	modelled := make(map[string]bool)
+	t := records.Type().Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		modelled[name] = true
+	}
+
+	for i, item := range items {
+		record := decoded.Index(i)
+		if err := json.Unmarshal(item, record.Addr().Interface()); err != nil {
+			return err
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(item, &fields); err != nil {
+			return err
+		}
+		for name := range fields {
+			if modelled[name] {
+				delete(fields, name)
+			}
+		}
+
+		if len(fields) > 0 {
+			record.FieldByName("Extra").Set(reflect.ValueOf(fields))
+		}
+	}
+
+	records.Set(decoded)
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package begetapi_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const getDataRecords = `{
+	"A": [{"ttl": 600, "address": "192.0.2.1"}],
+	"AAAA": [{"ttl": 600, "address": "2001:db8::1"}],
+	"MX": [{"ttl": 300, "exchange": "mx1.beget.com", "preference": 10}],
+	"TXT": [{"ttl": 300, "txtdata": "v=spf1 -all", "priority": 10}],
+	"CNAME": [{"ttl": 300, "cname": "target.example.com"}],
+	"NS": [{"ttl": 300, "nsdname": "ns1.beget.com"}],
+	"SRV": [{"ttl": 300, "priority": 10, "weight": 5, "port": 5060, "target": "sip.example.com"}],
+	"CAA": [{"ttl": 300, "flags": 0, "tag": "issue", "value": "letsencrypt.org"}],
+	"DNS": [{"value": "ns1.beget.com"}]
+}`
+
+func TestRecords_UnmarshalJSON(t *testing.T) {
+	var r begetapi.Records
+	require.NoError(t, json.Unmarshal([]byte(getDataRecords), &r))
+
+	assert.Equal(t, []begetapi.ARecord{{TTL: begetapi.TTL(600), Address: "192.0.2.1"}}, r.A)
+	assert.Equal(t, []begetapi.AAAARecord{{TTL: begetapi.TTL(600), Address: "2001:db8::1"}}, r.AAAA)
+	assert.Equal(t, []begetapi.MXRecord{{TTL: begetapi.TTL(300), Exchange: "mx1.beget.com", Preference: 10}}, r.MX)
+	assert.Equal(t, "v=spf1 -all", r.TXT[0].TXTData)
+	assert.Equal(t, []begetapi.CNAMERecord{{TTL: begetapi.TTL(300), CNAME: "target.example.com"}}, r.CNAME)
+	assert.Equal(t, []begetapi.NSRecord{{TTL: begetapi.TTL(300), NSDName: "ns1.beget.com"}}, r.NS)
+	assert.Equal(t, []begetapi.SRVRecord{{TTL: begetapi.TTL(300), Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com"}}, r.SRV)
+	assert.Equal(t, []begetapi.CAARecord{{TTL: begetapi.TTL(300), Flags: 0, Tag: "issue", Value: "letsencrypt.org"}}, r.CAA)
+}
+
+func TestRecords_RoundTrip(t *testing.T) {
+	var r begetapi.Records
+	require.NoError(t, json.Unmarshal([]byte(getDataRecords), &r))
+
+	data, err := json.Marshal(r)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, getDataRecords, string(data))
+}
+
+func TestRecords_RoundTrip_ZeroTTL(t *testing.T) {
+	const records = `{
+		"A": [{"ttl": 0, "address": "192.0.2.1"}, {"address": "192.0.2.2"}],
+		"TXT": [{"ttl": 0, "txtdata": "v=spf1 -all"}]
+	}`
+
+	var r begetapi.Records
+	require.NoError(t, json.Unmarshal([]byte(records), &r))
+	assert.Equal(t, begetapi.TTL(0), r.A[0].TTL)
+	assert.Nil(t, r.A[1].TTL)
+
+	require.NoError(t, begetapi.PushTXTRecord(&r, "challenge"))
+	data, err := json.Marshal(r)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{
+		"A": [{"ttl": 0, "address": "192.0.2.1"}, {"address": "192.0.2.2"}],
+		"TXT": [{"ttl": 0, "txtdata": "v=spf1 -all"}, {"txtdata": "challenge"}]
+	}`, string(data))
+}
+
+func TestRecords_UnknownFields(t *testing.T) {
+	var r begetapi.Records
+	require.NoError(t, json.Unmarshal([]byte(getDataRecords), &r))
+
+	assert.JSONEq(t, `10`, string(r.TXT[0].Extra["priority"]))
+	assert.JSONEq(t, `[{"value": "ns1.beget.com"}]`, string(r.Other["DNS"]))
+}
+
+func TestRecords_Empty(t *testing.T) {
+	for _, data := range []string{`[]`, `{}`, `null`} {
+		var r begetapi.Records
+		require.NoError(t, json.Unmarshal([]byte(data), &r), data)
+		assert.True(t, r.IsEmpty(), data)
+	}
+
+	data, err := json.Marshal(begetapi.Records{})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{}`, string(data))
+}
+
+func TestRecords_PushTXTRecord_Extra(t *testing.T) {
+	var r begetapi.Records
+	require.NoError(t, json.Unmarshal([]byte(getDataRecords), &r))
+	require.NoError(t, begetapi.PushTXTRecord(&r, "challenge"))
+
+	data, err := json.Marshal(r)
+	require.NoError(t, err)
+
+	var raw map[string][]map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &raw))
+	assert.Equal(t, []map[string]interface{}{
+		{"ttl": float64(300), "txtdata": "v=spf1 -all", "priority": float64(10)},
+		{"txtdata": "challenge"},
+	}, raw[begetapi.TXTKey])
+}
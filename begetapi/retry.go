@@ -0,0 +1,98 @@
+package begetapi
+
+import (
+	"errors"
+	"math/rand"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultRetryMaxAttempts = 3
+	DefaultRetryBaseDelay   = 500 * time.Millisecond
+	DefaultRetryMaxDelay    = 10 * time.Second
+)
+
+// RetryPolicy decides whether a failed API call is attempted again
+type RetryPolicy interface {
+	// Retry is called after the given attempt (starting from 1) failed with err,
+	// it returns the delay before the next attempt or false to give up
+	Retry(attempt int, err error) (time.Duration, bool)
+}
+
+// NoRetry gives up after the first failure
+var NoRetry RetryPolicy = noRetry{}
+
+type noRetry struct{}
+
+func (noRetry) Retry(int, error) (time.Duration, bool) {
+	return 0, false
+}
+
+// ExponentialBackoff doubles the delay after every failed attempt
+type ExponentialBackoff struct {
+	// MaxAttempts includes the first attempt
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Jitter is the randomized fraction of the delay, in [0, 1]
+	Jitter float64
+	// Retryable classifies errors, IsRetryable is used if it's nil
+	Retryable func(error) bool
+}
+
+func DefaultRetryPolicy() *ExponentialBackoff {
+	return &ExponentialBackoff{
+		MaxAttempts: DefaultRetryMaxAttempts,
+		BaseDelay:   DefaultRetryBaseDelay,
+		MaxDelay:    DefaultRetryMaxDelay,
+		Jitter:      0.5,
+	}
+}
+
+func (b *ExponentialBackoff) Retry(attempt int, err error) (time.Duration, bool) {
+	if attempt >= b.MaxAttempts {
+		return 0, false
+	}
+
+	retryable := b.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	if !retryable(err) {
+		return 0, false
+	}
+
+	delay := b.BaseDelay
+	for i := 1; i < attempt && (b.MaxDelay <= 0 || delay < b.MaxDelay); i++ {
+		delay *= 2
+	}
+	if b.MaxDelay > 0 && delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+
+	if b.Jitter > 0 {
+		jitter := time.Duration(b.Jitter * float64(delay))
+		if jitter > 0 {
+			delay = delay - jitter + time.Duration(rand.Int63n(int64(jitter)+1))
+		}
+	}
+
+	return delay, true
+}
+
+// IsRetryable reports whether err is a transient failure: a network error,
+// a 5xx response or a call rejected by the API's rate limit
+func IsRetryable(err error) bool {
+	if IsRateLimited(err) {
+		return true
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatus >= 500
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
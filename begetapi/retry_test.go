@@ -0,0 +1,63 @@
+package begetapi_test
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff_Retry(t *testing.T) {
+	policy := &begetapi.ExponentialBackoff{
+		MaxAttempts: 5,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    300 * time.Millisecond,
+		Retryable:   func(error) bool { return true },
+	}
+
+	for attempt, expected := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 300 * time.Millisecond,
+		4: 300 * time.Millisecond,
+	} {
+		delay, retry := policy.Retry(attempt, errors.New("failed"))
+		assert.True(t, retry, "attempt %d", attempt)
+		assert.Equal(t, expected, delay, "attempt %d", attempt)
+	}
+
+	_, retry := policy.Retry(5, errors.New("failed"))
+	assert.False(t, retry)
+}
+
+func TestExponentialBackoff_Jitter(t *testing.T) {
+	policy := &begetapi.ExponentialBackoff{
+		MaxAttempts: 3,
+		BaseDelay:   100 * time.Millisecond,
+		Jitter:      0.5,
+		Retryable:   func(error) bool { return true },
+	}
+
+	for i := 0; i < 100; i++ {
+		delay, retry := policy.Retry(2, errors.New("failed"))
+		assert.True(t, retry)
+		assert.GreaterOrEqual(t, delay, 100*time.Millisecond)
+		assert.LessOrEqual(t, delay, 200*time.Millisecond)
+	}
+}
+
+func TestExponentialBackoff_NotRetryable(t *testing.T) {
+	delay, retry := begetapi.DefaultRetryPolicy().Retry(1, errors.New("failed"))
+
+	assert.False(t, retry)
+	assert.Zero(t, delay)
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, begetapi.IsRetryable(&url.Error{Op: "Post", URL: "http://localhost", Err: errors.New("connection refused")}))
+	assert.False(t, begetapi.IsRetryable(errors.New("unmarshal response")))
+	assert.False(t, begetapi.IsRetryable(nil))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cmacme "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	cminformers "github.com/cert-manager/cert-manager/pkg/client/informers/externalversions"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	challengeCacheResync = 10 * time.Minute
+	challengeKeyIndex    = "spec.key"
+)
+
+// challengeCache finds the Challenge of a request by its key without listing
+// all the challenges of the cluster on every failure. The informer is started
+// on the first lookup: a webhook whose challenges don't fail doesn't watch them.
+type challengeCache struct {
+	client cmclient.Interface
+	stopCh <-chan struct{}
+
+	once    sync.Once
+	indexer cache.Indexer
+	synced  cache.InformerSynced
+}
+
+func newChallengeCache(client cmclient.Interface, stopCh <-chan struct{}) *challengeCache {
+	return &challengeCache{client: client, stopCh: stopCh}
+}
+
+// Find returns the Challenge with the key and the DNS name, the request
+// doesn't name it
+func (c *challengeCache) Find(ctx context.Context, key, dnsName string) (*cmacme.Challenge, error) {
+	c.once.Do(c.start)
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced) {
+		return nil, fmt.Errorf("waiting for the challenge cache to sync: %w", ctx.Err())
+	}
+
+	objs, err := c.indexer.ByIndex(challengeKeyIndex, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, obj := range objs {
+		challenge := obj.(*cmacme.Challenge)
+		if challenge.Spec.DNSName == dnsName {
+			return challenge, nil
+		}
+	}
+
+	return nil, errors.New("no challenge with the key is found")
+}
+
+func (c *challengeCache) start() {
+	klog.Info("challengeCache: starting challenge informer")
+
+	factory := cminformers.NewSharedInformerFactory(c.client, challengeCacheResync)
+	informer := factory.Acme().V1().Challenges().Informer()
+
+	// managed fields are of no use here and take a good part of the memory
+	informer.SetTransform(func(obj interface{}) (interface{}, error) {
+		if challenge, ok := obj.(*cmacme.Challenge); ok {
+			challenge.ManagedFields = nil
+		}
+
+		return obj, nil
+	})
+	if err := informer.AddIndexers(cache.Indexers{challengeKeyIndex: func(obj interface{}) ([]string, error) {
+		return []string{obj.(*cmacme.Challenge).Spec.Key}, nil
+	}}); err != nil {
+		// the informer isn't started yet, adding indexers can't fail
+		panic(err)
+	}
+
+	c.indexer = informer.GetIndexer()
+	c.synced = informer.HasSynced
+
+	factory.Start(c.stopCh)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultAPIAddress = ":8080"
+	defaultDNSAddress = ":5353"
+)
+
+// config describes the state the emulator starts with
+type config struct {
+	// APIAddress is the address of the HTTP API, point BEGET_DNS_API_URL at it
+	APIAddress string `json:"apiAddress,omitempty"`
+	// DNSAddress is the UDP address serving the records of the domains
+	DNSAddress string `json:"dnsAddress,omitempty"`
+
+	Accounts []accountConfig `json:"accounts"`
+}
+
+type accountConfig struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	// Domains are the domains added in the panel of the account
+	Domains []domainConfig `json:"domains,omitempty"`
+}
+
+type domainConfig struct {
+	// Name is the domain as it is added in beget's panel, e.g. example.com
+	Name       string   `json:"name"`
+	Subdomains []string `json:"subdomains,omitempty"`
+	// Records seeds the records of the domain and of its subdomains by name
+	Records map[string]begetapi.Records `json:"records,omitempty"`
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	cfg := &config{
+		APIAddress: defaultAPIAddress,
+		DNSAddress: defaultDNSAddress,
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("decoding config %s: %w", path, err)
+	}
+
+	if len(cfg.Accounts) == 0 {
+		return nil, errors.New("config must define at least one account")
+	}
+	for i, a := range cfg.Accounts {
+		if a.Login == "" || a.Password == "" {
+			return nil, fmt.Errorf("accounts[%d]: login and password are required", i)
+		}
+		for j, d := range a.Domains {
+			if d.Name == "" {
+				return nil, fmt.Errorf("accounts[%d].domains[%d]: name is required", i, j)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// newMock builds a mock holding the accounts, domains and records of the config
+func newMock(cfg *config) (*begetapi.BegetApiMock, error) {
+	mock := begetapi.NewBegetApiMock(cfg.Accounts[0].Login, cfg.Accounts[0].Password)
+	for _, a := range cfg.Accounts[1:] {
+		mock.AddAccount(a.Login, a.Password)
+	}
+
+	for _, a := range cfg.Accounts {
+		for _, d := range a.Domains {
+			if err := seedDomain(mock, a.Login, d); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return mock, nil
+}
+
+// seedDomain adds the domain to the account along with its subdomains and records
+func seedDomain(mock *begetapi.BegetApiMock, login string, d domainConfig) error {
+	domain := strings.TrimSuffix(d.Name, ".")
+	if _, err := mock.AddAccountDomain(login, domain); err != nil {
+		return fmt.Errorf("account %s: %w", login, err)
+	}
+
+	for _, s := range d.Subdomains {
+		if _, err := mock.AddSubdomain(qualify(s, domain)); err != nil {
+			return fmt.Errorf("domain %s: %w", domain, err)
+		}
+	}
+
+	for name, records := range d.Records {
+		if err := mock.SetRecords(qualify(name, domain), records); err != nil {
+			return fmt.Errorf("domain %s: %w", domain, err)
+		}
+	}
+
+	return nil
+}
+
+// qualify makes a name relative to the domain fully qualified, "@" stands for
+// the domain itself
+func qualify(name, domain string) string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "@" || name == domain {
+		return domain
+	}
+	if strings.HasSuffix(name, "."+domain) {
+		return name
+	}
+
+	return name + "." + domain
+}
@@ -0,0 +1,73 @@
+// Command beget-emulator serves an in-memory emulation of the Beget DNS API
+// and of the DNS servers of its domains, so the webhook can be run against it
+// instead of a real account, e.g. in staging clusters and CI:
+//
+//	beget-emulator -config emulator.yaml
+//	BEGET_DNS_API_URL=http://beget-emulator:8080 webhook
+//
+// The accounts, domains and records the emulator starts with are read from a
+// YAML file, see config.example.yaml. The state is lost on exit.
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+func main() {
+	configPath := flag.String("config", "emulator.yaml", "path of the YAML file with accounts, domains and records")
+	klog.InitFlags(nil)
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		klog.Fatalf("loading config: %v", err)
+	}
+
+	mock, err := newMock(cfg)
+	if err != nil {
+		klog.Fatalf("seeding the emulator: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 2)
+	go func() {
+		klog.Infof("serving the API on %s", cfg.APIAddress)
+		if err := mock.Run(cfg.APIAddress); err != nil && err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+	go func() {
+		klog.Infof("serving DNS on %s/udp", cfg.DNSAddress)
+		if err := mock.RunDnsAddr(cfg.DNSAddress); err != nil {
+			errs <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		klog.Info("shutting down")
+	case err = <-errs:
+		klog.Errorf("serving: %v", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	mock.Stop(shutdownCtx)
+	mock.StopDns(shutdownCtx)
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
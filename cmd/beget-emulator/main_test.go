@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig_Example(t *testing.T) {
+	cfg, err := loadConfig("config.example.yaml")
+	require.NoError(t, err)
+	require.Equal(t, ":8080", cfg.APIAddress)
+	require.Len(t, cfg.Accounts, 1)
+	require.Len(t, cfg.Accounts[0].Domains, 1)
+	require.Equal(t, "192.0.2.1", cfg.Accounts[0].Domains[0].Records["@"].A[0].Address)
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config string
+		err    string
+	}{
+		"no accounts":      {config: "apiAddress: :8080", err: "at least one account"},
+		"no password":      {config: "accounts: [{login: a}]", err: "accounts[0]: login and password are required"},
+		"no domain name":   {config: "accounts: [{login: a, password: b, domains: [{subdomains: [www]}]}]", err: "accounts[0].domains[0]: name is required"},
+		"unknown field":    {config: "accounts: [{login: a, password: b}]\napi: x", err: `unknown field "api"`},
+		"records as lists": {config: "accounts: [{login: a, password: b, domains: [{name: example.com, records: []}]}]", err: "decoding config"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.config), 0o600))
+
+			_, err := loadConfig(path)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestNewMock(t *testing.T) {
+	cfg := &config{
+		Accounts: []accountConfig{
+			{
+				Login:    "first",
+				Password: "first-password",
+				Domains: []domainConfig{{
+					Name:       "example.com",
+					Subdomains: []string{"www", "api.example.com."},
+					Records: map[string]begetapi.Records{
+						"@":   {A: []begetapi.ARecord{{Address: "192.0.2.1"}}},
+						"www": {CNAME: []begetapi.CNAMERecord{{CNAME: "example.com"}}},
+					},
+				}},
+			},
+			{
+				Login:    "second",
+				Password: "second-password",
+				Domains:  []domainConfig{{Name: "example.org"}},
+			},
+		},
+	}
+
+	mock, err := newMock(cfg)
+	require.NoError(t, err)
+	require.True(t, mock.HasName("www.example.com"))
+	require.True(t, mock.HasName("api.example.com"))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go mock.Serve(l)
+	t.Cleanup(func() { mock.Stop(context.TODO()) })
+
+	apiURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	client := begetapi.NewApiClient(apiURL, begetapi.WithRetryPolicy(begetapi.NoRetry))
+
+	first := begetapi.Credentials{Login: "first", Passwd: "first-password"}
+	second := begetapi.Credentials{Login: "second", Passwd: "second-password"}
+
+	records, err := client.GetData("example.com", first)
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1", records.A[0].Address)
+
+	records, err = client.GetData("www.example.com", first)
+	require.NoError(t, err)
+	require.Equal(t, "example.com", records.CNAME[0].CNAME)
+
+	// every account sees only its own domains
+	_, err = client.GetData("example.org", second)
+	require.NoError(t, err)
+	_, err = client.GetData("example.com", second)
+	require.True(t, begetapi.IsNotFound(err))
+
+	_, err = client.GetData("example.com", begetapi.Credentials{Login: "second", Passwd: "first-password"})
+	require.True(t, begetapi.IsAuthFailed(err))
+}
+
+func TestNewMock_UnknownSubdomainRecords(t *testing.T) {
+	_, err := newMock(&config{
+		Accounts: []accountConfig{{
+			Login:    "a",
+			Password: "b",
+			Domains: []domainConfig{{
+				Name:    "example.com",
+				Records: map[string]begetapi.Records{"www": {}},
+			}},
+		}},
+	})
+	require.ErrorContains(t, err, "domain example.com: no domain or subdomain www.example.com")
+}
+
+func TestNewMock_DomainOfTwoAccounts(t *testing.T) {
+	_, err := newMock(&config{
+		Accounts: []accountConfig{
+			{Login: "a", Password: "a", Domains: []domainConfig{{Name: "example.com"}}},
+			{Login: "b", Password: "b", Domains: []domainConfig{{Name: "example.com."}}},
+		},
+	})
+	require.ErrorContains(t, err, "account b: example.com is already added")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// longer chains are most likely a misconfiguration
+	maxCNAMEChain = 8
+	dnsTimeout    = 5 * time.Second
+)
+
+// followCNAME returns the name the chain of CNAME records starting at fqdn ends at
+func (e *Solver) followCNAME(ctx context.Context, fqdn string) (string, error) {
+	name := dns.Fqdn(fqdn)
+	seen := map[string]bool{name: true}
+
+	for i := 0; i < maxCNAMEChain; i++ {
+		target, err := e.lookupCNAME(ctx, name)
+		if err != nil {
+			return "", err
+		}
+
+		if target == "" {
+			return trimFqdn(name), nil
+		}
+
+		klog.Infof("solver.followCNAME: %s is an alias of %s", name, target)
+
+		if seen[target] {
+			return "", fmt.Errorf("CNAME loop at %s following %s", target, fqdn)
+		}
+		seen[target] = true
+		name = target
+	}
+
+	return "", fmt.Errorf("CNAME chain of %s is longer than %d", fqdn, maxCNAMEChain)
+}
+
+// lookupCNAME returns the target of the CNAME record of the name, if it has one
+func (e *Solver) lookupCNAME(ctx context.Context, name string) (string, error) {
+	nameservers, err := e.resolvers()
+	if err != nil {
+		return "", err
+	}
+
+	in, err := exchange(ctx, nameservers, name, dns.TypeCNAME)
+	if err != nil {
+		return "", err
+	}
+
+	for _, rr := range in.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return strings.ToLower(cname.Target), nil
+		}
+	}
+
+	return "", nil
+}
+
+// exchange asks the nameservers in turn until one of them answers the query,
+// an answer that the name doesn't exist is an answer too
+func exchange(ctx context.Context, nameservers []string, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+
+	client := &dns.Client{Timeout: dnsTimeout}
+
+	var lastErr error
+	for _, ns := range nameservers {
+		in, _, err := client.ExchangeContext(ctx, msg, ns)
+		if err != nil {
+			lastErr = err
+
+			continue
+		}
+
+		if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s answered %s", ns, dns.RcodeToString[in.Rcode])
+
+			continue
+		}
+
+		return in, nil
+	}
+
+	return nil, fmt.Errorf("looking up %s of %s: %w", dns.TypeToString[qtype], name, lastErr)
+}
+
+// resolvers returns the nameservers used for lookups, the system ones by default
+func (e *Solver) resolvers() ([]string, error) {
+	if len(e.nameservers) > 0 {
+		return e.nameservers, nil
+	}
+
+	cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("reading system nameservers: %w", err)
+	}
+
+	nameservers := make([]string, 0, len(cfg.Servers))
+	for _, server := range cfg.Servers {
+		nameservers = append(nameservers, net.JoinHostPort(server, cfg.Port))
+	}
+
+	return nameservers, nil
+}
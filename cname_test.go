@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSolver_FollowCNAME(t *testing.T) {
+	solver, api, mock := newTestSolverWithMock(t)
+	solver.nameservers = []string{startTestDNS(t, mock)}
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	// customer.org is hosted elsewhere, its challenges are delegated to
+	// example.com hosted in beget through an intermediate name
+	mock.AddDomain("customer.org")
+	mock.AddDomain("example.net")
+	for name, target := range map[string]string{
+		"_acme-challenge.customer.org": "customer-org.example.net",
+		"customer-org.example.net":     "customer-org.acme.example.com.",
+	} {
+		_, err := mock.AddSubdomain(name)
+		require.NoError(t, err)
+		require.NoError(t, api.ChangeRecords(name, begetapi.Records{CNAME: []begetapi.CNAMERecord{{CNAME: target}}}, creds))
+	}
+
+	cfg := testConfig()
+	cfg.FollowCNAME = true
+	ch := newTestChallengeWithConfig(t, "_acme-challenge.customer.org.", "challenge", cfg)
+	ch.ResolvedZone = "customer.org."
+
+	require.NoError(t, solver.Present(ch))
+
+	records, err := api.GetData("customer-org.acme.example.com", creds)
+	require.NoError(t, err)
+	require.Equal(t, []begetapi.TXTRecord{{TXTData: "challenge"}}, records.TXT)
+
+	records, err = api.GetData("_acme-challenge.customer.org", creds)
+	require.NoError(t, err)
+	require.Empty(t, records.TXT)
+
+	require.NoError(t, solver.CleanUp(ch))
+
+	records, err = api.GetData("customer-org.acme.example.com", creds)
+	require.NoError(t, err)
+	require.Empty(t, records.TXT)
+}
+
+func TestSolver_FollowCNAME_Loop(t *testing.T) {
+	solver, api, mock := newTestSolverWithMock(t)
+	solver.nameservers = []string{startTestDNS(t, mock)}
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	for name, target := range map[string]string{
+		"_acme-challenge.example.com": "loop.example.com",
+		"loop.example.com":            "_acme-challenge.example.com",
+	} {
+		_, err := mock.AddSubdomain(name)
+		require.NoError(t, err)
+		require.NoError(t, api.ChangeRecords(name, begetapi.Records{CNAME: []begetapi.CNAMERecord{{CNAME: target}}}, creds))
+	}
+
+	cfg := testConfig()
+	cfg.FollowCNAME = true
+
+	err := solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.example.com.", "challenge", cfg))
+	require.ErrorContains(t, err, "CNAME loop")
+}
+
+func TestSolver_DelegationTarget(t *testing.T) {
+	solver, api := newTestSolver(t)
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	cfg := testConfig()
+	cfg.DelegationTarget = "delegated.acme.example.com."
+	ch := newTestChallengeWithConfig(t, "_acme-challenge.customer.org.", "challenge", cfg)
+	ch.ResolvedZone = "customer.org."
+
+	require.NoError(t, solver.Present(ch))
+
+	records, err := api.GetData("delegated.acme.example.com", creds)
+	require.NoError(t, err)
+	require.Equal(t, []begetapi.TXTRecord{{TXTData: "challenge"}}, records.TXT)
+
+	require.NoError(t, solver.CleanUp(ch))
+
+	records, err = api.GetData("delegated.acme.example.com", creds)
+	require.NoError(t, err)
+	require.Empty(t, records.TXT)
+}
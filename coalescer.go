@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+)
+
+// txtChange adds the challenge value to the TXT records of a name or removes it
+type txtChange struct {
+	value  string
+	remove bool
+	// zone is the zone cert-manager resolved for an added value, the
+	// domain the name is created in if it doesn't exist yet
+	zone string
+	// deleteSubdomain deletes the subdomain created for the challenge
+	// if no records of the name are left
+	deleteSubdomain bool
+}
+
+// flushFunc applies the changes in a single read and write of the records of
+// the name and returns the records written. A change that can't be applied
+// is left out and gets its error at its index in rejected, the others are
+// still written; err fails all of them
+type flushFunc func(ctx context.Context, changes []txtChange) (records begetapi.Records, rejected []error, err error)
+
+type flushResult struct {
+	records begetapi.Records
+	err     error
+}
+
+// writeBatch is the changes of a name waiting to be written
+type writeBatch struct {
+	flush   flushFunc
+	ctx     context.Context
+	changes []txtChange
+	waiters []chan flushResult
+}
+
+// drop removes the change of the waiter from the batch
+func (b *writeBatch) drop(done chan flushResult) {
+	for i, waiter := range b.waiters {
+		if waiter == done {
+			b.changes = append(b.changes[:i], b.changes[i+1:]...)
+			b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+
+			return
+		}
+	}
+}
+
+// writeCoalescer merges the changes of concurrent challenges on the same name,
+// e.g. of the wildcard and the apex of a certificate: changeRecords replaces
+// all the records of the name, so every write is a read and a write anyway.
+// A write starts at once if the name is free; the changes arriving while the
+// previous write of the name is in progress are written together after it
+type writeCoalescer struct {
+	locks *keyedMutex
+
+	mu      sync.Mutex
+	pending map[string]*writeBatch
+}
+
+func newWriteCoalescer(locks *keyedMutex) *writeCoalescer {
+	return &writeCoalescer{
+		locks:   locks,
+		pending: make(map[string]*writeBatch),
+	}
+}
+
+// Submit queues the change of the name under key and waits for it to be
+// written, flush is used if the change starts a new batch: anything a flush
+// needs from a single request must come with its change. A change given up
+// by its caller is dropped unless its write has already started, then it's
+// applied regardless
+func (c *writeCoalescer) Submit(ctx context.Context, key string, change txtChange, flush flushFunc) (begetapi.Records, error) {
+	done := make(chan flushResult, 1)
+
+	c.mu.Lock()
+	batch, ok := c.pending[key]
+	if !ok {
+		// the batch outlives the context of the request it's started by,
+		// the others waiting for it must not fail with it
+		batch = &writeBatch{flush: flush, ctx: detachedContext{ctx}}
+		c.pending[key] = batch
+		go c.write(key, batch)
+	}
+	batch.changes = append(batch.changes, change)
+	batch.waiters = append(batch.waiters, done)
+	c.mu.Unlock()
+
+	select {
+	case res := <-done:
+		return res.records, res.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		if c.pending[key] == batch {
+			batch.drop(done)
+		}
+		c.mu.Unlock()
+
+		return begetapi.Records{}, ctx.Err()
+	}
+}
+
+func (c *writeCoalescer) write(key string, batch *writeBatch) {
+	ctx, cancel := context.WithTimeout(batch.ctx, webhookRequestTimeout)
+	defer cancel()
+
+	unlock, err := c.locks.Lock(ctx, key)
+
+	// no more changes join or leave the batch once the name is locked for it
+	c.mu.Lock()
+	delete(c.pending, key)
+	c.mu.Unlock()
+
+	var records begetapi.Records
+	var rejected []error
+	if err == nil {
+		if len(batch.changes) > 0 {
+			records, rejected, err = batch.flush(ctx, batch.changes)
+		}
+		unlock()
+	}
+
+	for i, done := range batch.waiters {
+		res := flushResult{records: records, err: err}
+		if err == nil && rejected != nil {
+			res.err = rejected[i]
+		}
+		done <- res
+	}
+}
+
+// detachedContext keeps the values of the context, e.g. its span, but not its
+// cancellation and deadline
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	acme "github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSolver_CoalescesWrites(t *testing.T) {
+	solver, api := newTestSolver(t)
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+	changeRecords := solver.metrics.apiRequests.WithLabelValues("dns/changeRecords", "success")
+	key := recordLockKey(creds, "_acme-challenge.example.com")
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	run := func(op func(*acme.ChallengeRequest) error) {
+		// a write of the name is in progress, the challenges wait for it together
+		unlock, err := solver.recordLocks.Lock(context.TODO(), key)
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, len(keys))
+		for _, key := range keys {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				errs <- op(newTestChallenge(t, "_acme-challenge.example.com.", key))
+			}(key)
+		}
+		waitForBatch(t, solver.writes, key, len(keys))
+		unlock()
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	}
+
+	run(solver.Present)
+	require.Equal(t, 1.0, testutil.ToFloat64(changeRecords))
+
+	records, err := api.GetData("_acme-challenge.example.com", creds)
+	require.NoError(t, err)
+	require.Len(t, records.TXT, len(keys))
+
+	run(solver.CleanUp)
+	require.Equal(t, 2.0, testutil.ToFloat64(changeRecords))
+
+	records, err = api.GetData("_acme-challenge.example.com", creds)
+	require.NoError(t, err)
+	require.Empty(t, records.TXT)
+
+	// without a write in progress a challenge is written at once
+	start := time.Now()
+	require.NoError(t, solver.Present(newTestChallenge(t, "_acme-challenge.example.com.", "f")))
+	require.Equal(t, 3.0, testutil.ToFloat64(changeRecords))
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestSolver_CoalescesWrites_MixedCase(t *testing.T) {
+	solver, api := newTestSolver(t)
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+	require.Equal(t, recordLockKey(creds, "_acme-challenge.www.example.com"), recordLockKey(creds, "_acme-challenge.WWW.example.com."))
+
+	_, err := api.AddSubdomainVirtual("_acme-challenge.www", 1, creds)
+	require.NoError(t, err)
+
+	// the names are the same to beget, so is their lock
+	unlock, err := solver.recordLocks.Lock(context.TODO(), recordLockKey(creds, "_acme-challenge.www.example.com"))
+	require.NoError(t, err)
+
+	errs := make(chan error, 2)
+	for _, name := range []string{"_acme-challenge.www.example.com.", "_acme-challenge.WWW.example.com."} {
+		go func(name string) {
+			errs <- solver.Present(newTestChallenge(t, name, name))
+		}(name)
+	}
+	waitForBatch(t, solver.writes, recordLockKey(creds, "_acme-challenge.www.example.com"), 2)
+	unlock()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	records, err := api.GetData("_acme-challenge.www.example.com", creds)
+	require.NoError(t, err)
+	require.Len(t, records.TXT, 2)
+}
+
+func TestSolver_CoalescesWrites_ResolvedZone(t *testing.T) {
+	solver, api, mock := newTestSolverWithMock(t)
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+	mock.AddDomain("www.example.com")
+
+	unlock, err := solver.recordLocks.Lock(context.TODO(), recordLockKey(creds, "_acme-challenge.api.www.example.com"))
+	require.NoError(t, err)
+
+	// the clean up of an earlier challenge starts the batch of the name
+	cleanUp := make(chan error, 1)
+	go func() {
+		cleanUp <- solver.CleanUp(newTestChallenge(t, "_acme-challenge.api.www.example.com.", "old"))
+	}()
+	waitForBatch(t, solver.writes, recordLockKey(creds, "_acme-challenge.api.www.example.com"), 1)
+
+	// cert-manager found the zone of the name to be example.com
+	present := make(chan error, 1)
+	go func() {
+		present <- solver.Present(newTestChallenge(t, "_acme-challenge.api.www.example.com.", "new"))
+	}()
+	waitForBatch(t, solver.writes, recordLockKey(creds, "_acme-challenge.api.www.example.com"), 2)
+	unlock()
+
+	require.NoError(t, <-present)
+	require.NoError(t, <-cleanUp)
+
+	domains, err := api.GetDomainList(creds)
+	require.NoError(t, err)
+	subdomains, err := api.GetSubdomainList(creds)
+	require.NoError(t, err)
+	require.Len(t, subdomains, 1)
+	require.Equal(t, domains[0].ID, subdomains[0].DomainID, "the subdomain is expected in the resolved zone")
+}
+
+func TestWriteCoalescer(t *testing.T) {
+	locks := newKeyedMutex()
+	coalescer := newWriteCoalescer(locks)
+
+	var flushed [][]txtChange
+	flush := func(ctx context.Context, changes []txtChange) (begetapi.Records, []error, error) {
+		flushed = append(flushed, changes)
+
+		rejected := make([]error, len(changes))
+		for i, change := range changes {
+			if change.value == "c" {
+				rejected[i] = errors.New("c is rejected")
+			}
+		}
+
+		return begetapi.Records{}, rejected, nil
+	}
+
+	unlock, err := locks.Lock(context.TODO(), "login/example.com")
+	require.NoError(t, err)
+
+	submit := func(ctx context.Context, change txtChange) <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := coalescer.Submit(ctx, "login/example.com", change, flush)
+			errs <- err
+		}()
+
+		return errs
+	}
+
+	// the caller starting the batch gives up before it's written: its
+	// change is dropped, the others still get their results
+	ctx, cancel := context.WithCancel(context.Background())
+	a := submit(ctx, txtChange{value: "a"})
+	waitForBatch(t, coalescer, "login/example.com", 1)
+	b := submit(context.Background(), txtChange{value: "b", remove: true})
+	waitForBatch(t, coalescer, "login/example.com", 2)
+	c := submit(context.Background(), txtChange{value: "c"})
+	waitForBatch(t, coalescer, "login/example.com", 3)
+
+	cancel()
+	require.ErrorIs(t, <-a, context.Canceled)
+	waitForBatch(t, coalescer, "login/example.com", 2)
+
+	unlock()
+	require.NoError(t, <-b)
+	require.EqualError(t, <-c, "c is rejected")
+	require.Equal(t, [][]txtChange{{{value: "b", remove: true}, {value: "c"}}}, flushed)
+}
+
+// waitForBatch waits until the batch of the key waiting for its write holds n changes
+func waitForBatch(t *testing.T, c *writeCoalescer, key string, n int) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		batch, ok := c.pending[key]
+
+		return ok && len(batch.changes) == n
+	}, 5*time.Second, time.Millisecond)
+}
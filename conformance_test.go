@@ -0,0 +1,60 @@
+//go:build conformance
+
+// The conformance suite starts a control plane from the binaries of the test
+// assets, the fixture package panics on init without them. It is built only
+// with the conformance tag, `make test` downloads the assets and sets it.
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	dns "github.com/cert-manager/cert-manager/test/acme"
+)
+
+var (
+	zone = os.Getenv("TEST_ZONE_NAME")
+)
+
+func TestRunsSuite(t *testing.T) {
+	// The manifest path should contain a file named config.json that is a
+	// snippet of valid configuration that should be included on the
+	// ChallengeRequest passed as part of the test cases.
+	begerURL, err := url.Parse("http://localhost:8080")
+	if err != nil {
+		t.FailNow()
+	}
+
+	api := begetapi.NewBegetApiMock("login", "password")
+	api.AddDomain("example.com")
+	go func() {
+		api.Run(":8080")
+		t.Log("run")
+	}()
+	go func() {
+		if err := api.RunDns("59351"); err != nil {
+			t.Errorf("running dns: %v", err)
+		}
+		t.Log("run dns")
+	}()
+	defer func() {
+		api.Stop(context.TODO())
+		api.StopDns(context.TODO())
+		t.Log("stopped servers")
+	}()
+
+	solver := New(begerURL)
+	fixture := dns.NewFixture(solver,
+		dns.SetResolvedZone("example.com."),
+		dns.SetManifestPath("testdata/beget"),
+		dns.SetDNSServer("127.0.0.1:59351"),
+		dns.SetUseAuthoritative(false),
+	)
+
+	fixture.RunConformance(t)
+
+}
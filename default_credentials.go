@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+)
+
+// defaultCredentials are the credentials of the webhook itself, used by issuers
+// that don't refer to any secret: given in the environment or in files, the
+// files are read again once they change, e.g. when a mounted secret is updated
+type defaultCredentials struct {
+	login  credentialSource
+	passwd credentialSource
+}
+
+type credentialSource interface {
+	value() (string, error)
+}
+
+// newDefaultCredentials returns nil if neither the login nor the password is given
+func newDefaultCredentials(login, loginFile, passwd, passwdFile string) (*defaultCredentials, error) {
+	loginSource, err := newCredentialSource("BEGET_LOGIN", login, loginFile)
+	if err != nil {
+		return nil, err
+	}
+	passwdSource, err := newCredentialSource("BEGET_PASSWD", passwd, passwdFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if loginSource == nil && passwdSource == nil {
+		return nil, nil
+	}
+	if loginSource == nil || passwdSource == nil {
+		return nil, fmt.Errorf("both the default beget login and password must be given")
+	}
+
+	return &defaultCredentials{login: loginSource, passwd: passwdSource}, nil
+}
+
+func newCredentialSource(name, value, file string) (credentialSource, error) {
+	switch {
+	case value != "" && file != "":
+		return nil, fmt.Errorf("only one of %s and %s_FILE may be set", name, name)
+	case value != "":
+		return staticCredential(value), nil
+	case file != "":
+		return &fileCredential{path: file}, nil
+	}
+
+	return nil, nil
+}
+
+func (d *defaultCredentials) Get() (begetapi.Credentials, error) {
+	login, err := d.login.value()
+	if err != nil {
+		return begetapi.Credentials{}, fmt.Errorf("reading the default beget login: %w", err)
+	}
+	passwd, err := d.passwd.value()
+	if err != nil {
+		return begetapi.Credentials{}, fmt.Errorf("reading the default beget password: %w", err)
+	}
+
+	return begetapi.Credentials{Login: login, Passwd: passwd}, nil
+}
+
+type staticCredential string
+
+func (c staticCredential) value() (string, error) {
+	return string(c), nil
+}
+
+// fileCredential keeps the content of the file until its modification time
+// or size changes, stat follows the symlinks a mounted secret is updated with
+type fileCredential struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	content string
+}
+
+func (c *fileCredential) value() (string, error) {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.content != "" && info.ModTime().Equal(c.modTime) && info.Size() == c.size {
+		return c.content, nil
+	}
+
+	content, err := os.ReadFile(c.path)
+	if err != nil {
+		return "", err
+	}
+
+	value := strings.TrimRight(string(content), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", c.path)
+	}
+
+	c.modTime, c.size, c.content = info.ModTime(), info.Size(), value
+
+	return value, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSolver_DefaultCredentials(t *testing.T) {
+	solver, api := newTestSolver(t)
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	dir := t.TempDir()
+	passwdFile := filepath.Join(dir, "passwd")
+	require.NoError(t, os.WriteFile(passwdFile, []byte("password\n"), 0o600))
+
+	var err error
+	solver.defaultCredentials, err = newDefaultCredentials("login", "", "", passwdFile)
+	require.NoError(t, err)
+
+	ch := newTestChallenge(t, "_acme-challenge.example.com.", "challenge")
+	ch.Config = nil
+	require.NoError(t, solver.Present(ch))
+
+	records, err := api.GetData("_acme-challenge.example.com", creds)
+	require.NoError(t, err)
+	require.Equal(t, []begetapi.TXTRecord{{TXTData: "challenge"}}, records.TXT)
+
+	// the refs of the issuer take precedence
+	cfg := testConfig()
+	cfg.APIPasswdSecretRef.Key = "login"
+	err = solver.CleanUp(newTestChallengeWithConfig(t, "_acme-challenge.example.com.", "challenge", cfg))
+	require.True(t, begetapi.IsAuthFailed(err))
+
+	// a changed file is read again
+	require.NoError(t, os.WriteFile(passwdFile, []byte("rotated"), 0o600))
+	require.NoError(t, os.Chtimes(passwdFile, time.Now(), time.Now().Add(time.Minute)))
+
+	got, err := solver.defaultCredentials.Get()
+	require.NoError(t, err)
+	require.Equal(t, begetapi.Credentials{Login: "login", Passwd: "rotated"}, got)
+}
+
+func TestNewDefaultCredentials(t *testing.T) {
+	d, err := newDefaultCredentials("", "", "", "")
+	require.NoError(t, err)
+	require.Nil(t, d)
+
+	_, err = newDefaultCredentials("login", "", "", "")
+	require.ErrorContains(t, err, "both the default beget login and password must be given")
+
+	_, err = newDefaultCredentials("login", "/login", "password", "")
+	require.ErrorContains(t, err, "only one of BEGET_LOGIN and BEGET_LOGIN_FILE may be set")
+
+	d, err = newDefaultCredentials("", filepath.Join(t.TempDir(), "missing"), "password", "")
+	require.NoError(t, err)
+	_, err = d.Get()
+	require.ErrorContains(t, err, "reading the default beget login")
+}
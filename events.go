@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	acme "github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	cmacme "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	certmgr "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmscheme "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/scheme"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// reasons of the events recorded for failed challenges
+const (
+	ReasonAuthFailed     = "BegetAuthFailed"
+	ReasonUnknownDomain  = "BegetUnknownDomain"
+	ReasonRateLimited    = "BegetRateLimited"
+	ReasonAPIUnavailable = "BegetAPIUnavailable"
+	ReasonFailed         = "BegetFailed"
+)
+
+const (
+	eventComponent = "cert-manager-webhook-beget"
+	// the message of an event is limited by the API server
+	maxEventMessage = 1024
+	eventTimeout    = 10 * time.Second
+)
+
+// newEventRecorder returns a recorder writing events through the client until stopCh is closed
+func newEventRecorder(client kubernetes.Interface, stopCh <-chan struct{}) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	go func() {
+		<-stopCh
+		broadcaster.Shutdown()
+	}()
+
+	return broadcaster.NewRecorder(cmscheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// eventReason categorizes the error of a challenge for its users
+func eventReason(err error) string {
+	var unknownDomain *unknownDomainError
+
+	switch {
+	case begetapi.IsAuthFailed(err):
+		return ReasonAuthFailed
+	case errors.As(err, &unknownDomain), begetapi.IsNotFound(err):
+		return ReasonUnknownDomain
+	case begetapi.IsRateLimited(err):
+		return ReasonRateLimited
+	case begetapi.IsRetryable(err), errors.Is(err, context.DeadlineExceeded):
+		return ReasonAPIUnavailable
+	}
+
+	return ReasonFailed
+}
+
+// recordFailure records a warning event on the Challenge of the request, and on
+// its issuer too if the credentials are rejected: all its challenges will fail.
+// The events are recorded in the background, finding the Challenge may wait
+// for the challenge cache to sync and the webhook returns its error right away
+func (e *Solver) recordFailure(ch *acme.ChallengeRequest, operation string, err error) {
+	if e.recorder == nil || e.challenges == nil || ch == nil {
+		return
+	}
+
+	e.pendingEvents.Add(1)
+	go func() {
+		defer e.pendingEvents.Done()
+		e.recordFailureEvents(ch, operation, err)
+	}()
+}
+
+func (e *Solver) recordFailureEvents(ch *acme.ChallengeRequest, operation string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+
+	// the request doesn't name the Challenge, its key is unique though
+	challenge, lookupErr := e.challenges.Find(ctx, ch.Key, ch.DNSName)
+	if lookupErr != nil {
+		klog.Errorf("solver.recordFailure: finding the challenge of %s: %v", ch.DNSName, lookupErr)
+
+		return
+	}
+
+	reason := eventReason(err)
+	message := truncateMessage(operation + " failed: " + err.Error())
+
+	e.recorder.Event(challenge, corev1.EventTypeWarning, reason, message)
+
+	if reason != ReasonAuthFailed {
+		return
+	}
+
+	issuer, lookupErr := e.findIssuer(ctx, challenge)
+	if lookupErr != nil {
+		klog.Errorf("solver.recordFailure: finding the issuer of challenge %s/%s: %v", challenge.Namespace, challenge.Name, lookupErr)
+
+		return
+	}
+
+	e.recorder.Event(issuer, corev1.EventTypeWarning, reason, message)
+}
+
+func (e *Solver) findIssuer(ctx context.Context, challenge *cmacme.Challenge) (runtime.Object, error) {
+	ref := challenge.Spec.IssuerRef
+	if ref.Kind == certmgr.ClusterIssuerKind {
+		return e.cmClient.CertmanagerV1().ClusterIssuers().Get(ctx, ref.Name, v1.GetOptions{})
+	}
+
+	return e.cmClient.CertmanagerV1().Issuers(challenge.Namespace).Get(ctx, ref.Name, v1.GetOptions{})
+}
+
+// truncateMessage cuts the message to the limit of the API server, on a rune
+// boundary: beget tells its errors in Russian
+func truncateMessage(message string) string {
+	if len(message) <= maxEventMessage {
+		return message
+	}
+
+	end := maxEventMessage - 3
+	for end > 0 && !utf8.RuneStart(message[end]) {
+		end--
+	}
+
+	return message[:end] + "..."
+}
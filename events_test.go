@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	cmacme "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	certmgr "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	certmgrv1 "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	cmfake "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/require"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSolver_RecordsFailureEvents(t *testing.T) {
+	solver, _, mock := newTestSolverWithMock(t)
+
+	newChallenge := func(name, dnsName, key string) *cmacme.Challenge {
+		return &cmacme.Challenge{
+			ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "apps"},
+			Spec: cmacme.ChallengeSpec{
+				DNSName:   dnsName,
+				Key:       key,
+				IssuerRef: certmgrv1.ObjectReference{Name: "beget", Kind: certmgr.ClusterIssuerKind},
+			},
+		}
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	solver.recorder = recorder
+	cmClient := cmfake.NewSimpleClientset(
+		newChallenge("example-com", "example.com", "challenge"),
+		newChallenge("example-org", "example.org", "other"),
+		&certmgr.ClusterIssuer{ObjectMeta: v1.ObjectMeta{Name: "beget"}},
+	)
+	var lists atomic.Int32
+	cmClient.PrependReactor("list", "challenges", func(k8stesting.Action) (bool, runtime.Object, error) {
+		lists.Add(1)
+		return false, nil, nil
+	})
+	solver.setCMClient(cmClient)
+
+	// a rejected login concerns every challenge of the issuer
+	mock.FailNext(1, http.StatusOK, `{"status":"error","error_text":"No such user","error_code":"AUTH_ERROR"}`)
+	ch := newTestChallenge(t, "_acme-challenge.example.com.", "challenge")
+	ch.DNSName = "example.com"
+	require.Error(t, solver.Present(ch))
+	solver.pendingEvents.Wait()
+
+	require.Len(t, recorder.Events, 2)
+	require.Contains(t, <-recorder.Events, "Warning BegetAuthFailed present failed: ")
+	require.Contains(t, <-recorder.Events, "Warning BegetAuthFailed present failed: ")
+
+	ch = newTestChallenge(t, "_acme-challenge.example.org.", "other")
+	ch.DNSName, ch.ResolvedZone = "example.org", "example.org."
+	require.Error(t, solver.Present(ch))
+	solver.pendingEvents.Wait()
+
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, `Warning BegetUnknownDomain present failed: preparing the challenge name via API: no domain of the beget account of secret "default/beget-credentials" key "login" covers _acme-challenge.example.org`)
+
+	// a challenge that isn't found gets no events
+	ch = newTestChallenge(t, "_acme-challenge.example.org.", "unknown")
+	ch.ResolvedZone = "example.org."
+	require.Error(t, solver.Present(ch))
+	solver.pendingEvents.Wait()
+	require.Empty(t, recorder.Events)
+
+	// the challenges are watched, not listed on every failure
+	require.Equal(t, int32(1), lists.Load())
+}
+
+func TestSolver_RecordsFailureEvents_ChallengesForbidden(t *testing.T) {
+	solver, _, mock := newTestSolverWithMock(t)
+
+	recorder := record.NewFakeRecorder(10)
+	solver.recorder = recorder
+	cmClient := cmfake.NewSimpleClientset()
+	// the challenge cache never syncs without list and watch of challenges
+	for _, verb := range []string{"list", "watch"} {
+		cmClient.PrependReactor(verb, "challenges", func(k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, k8serrors.NewForbidden(cmacme.Resource("challenges"), "", errors.New("forbidden"))
+		})
+	}
+	solver.setCMClient(cmClient)
+
+	mock.FailNext(1, http.StatusOK, `{"status":"error","error_text":"No such user","error_code":"AUTH_ERROR"}`)
+	start := time.Now()
+	require.Error(t, solver.Present(newTestChallenge(t, "_acme-challenge.example.com.", "challenge")))
+	require.Less(t, time.Since(start), eventTimeout/2, "the error is expected to be returned before the events are recorded")
+}
+
+func TestTruncateMessage(t *testing.T) {
+	require.Equal(t, "короткое", truncateMessage("короткое"))
+
+	// two bytes a rune, the limit falls in the middle of one
+	message := truncateMessage(strings.Repeat("ы", maxEventMessage))
+	require.True(t, utf8.ValidString(message))
+	require.LessOrEqual(t, len(message), maxEventMessage)
+	require.Equal(t, strings.Repeat("ы", (maxEventMessage-4)/2)+"...", message)
+}
+
+func TestEventReason(t *testing.T) {
+	for err, reason := range map[error]string{
+		&begetapi.APIError{HTTPStatus: http.StatusForbidden}:                                                   ReasonAuthFailed,
+		&begetapi.APIError{HTTPStatus: http.StatusTooManyRequests}:                                             ReasonRateLimited,
+		&begetapi.RateLimitError{Method: "dns/getData", Err: errors.New("would exceed context deadline")}:      ReasonRateLimited,
+		&begetapi.APIError{HTTPStatus: http.StatusBadGateway}:                                                  ReasonAPIUnavailable,
+		fmt.Errorf("wrapped: %w", context.DeadlineExceeded):                                                    ReasonAPIUnavailable,
+		fmt.Errorf("wrapped: %w", &unknownDomainError{source: "the default credentials", fqdn: "example.org"}): ReasonUnknownDomain,
+		&begetapi.APIError{Errors: []begetapi.ErrorEntry{{Code: "METHOD_FAILED", Text: "NOT_FOUND_ERROR"}}}:    ReasonUnknownDomain,
+		errors.New("invalid solver config"):                                                                    ReasonFailed,
+	} {
+		require.Equal(t, reason, eventReason(err), err.Error())
+	}
+}
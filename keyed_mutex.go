@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// keyedMutex serializes callers sharing a key, e.g. read-modify-write cycles
+// on the same record set, while letting different keys proceed in parallel
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+// refMutex is a mutex whose lock can be given up: it's held while its
+// channel is full
+type refMutex struct {
+	held chan struct{}
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*refMutex)}
+}
+
+// Lock blocks until the key is free or ctx is done, and returns the function
+// releasing it
+func (k *keyedMutex) Lock(ctx context.Context, key string) (unlock func(), err error) {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &refMutex{held: make(chan struct{}, 1)}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	select {
+	case l.held <- struct{}{}:
+	case <-ctx.Done():
+		k.release(key, l)
+
+		return nil, ctx.Err()
+	}
+
+	return func() {
+		<-l.held
+		k.release(key, l)
+	}, nil
+}
+
+func (k *keyedMutex) release(key string, l *refMutex) {
+	k.mu.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+	k.mu.Unlock()
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyedMutex_Context(t *testing.T) {
+	locks := newKeyedMutex()
+
+	unlock, err := locks.Lock(context.TODO(), "key")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = locks.Lock(ctx, "key")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	unlock()
+	require.Empty(t, locks.locks)
+}
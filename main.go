@@ -1,30 +1,62 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
 
 	acme "github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	"github.com/cert-manager/cert-manager/pkg/acme/webhook/cmd"
 	certmgrv1 "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	cmclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
 	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
 const BegetProductionApiUrl = "https://api.beget.com"
 
+// kube-apiserver drops a request to an aggregated API after its default
+// --request-timeout, there is no point in working on a challenge any longer
+const webhookRequestTimeout = 60 * time.Second
+
 var GroupName = os.Getenv("GROUP_NAME")
 var BegetDnsApiUrl = os.Getenv("BEGET_DNS_API_URL")
+var BegetApiRequestTimeout = os.Getenv("BEGET_API_REQUEST_TIMEOUT")
+var BegetApiTimeout = os.Getenv("BEGET_API_TIMEOUT")
+var BegetApiRetryMaxAttempts = os.Getenv("BEGET_API_RETRY_MAX_ATTEMPTS")
+var BegetApiRetryBaseDelay = os.Getenv("BEGET_API_RETRY_BASE_DELAY")
+var BegetApiRetryMaxDelay = os.Getenv("BEGET_API_RETRY_MAX_DELAY")
+var BegetApiRateLimit = os.Getenv("BEGET_API_RATE_LIMIT")
+var BegetApiRateBurst = os.Getenv("BEGET_API_RATE_BURST")
+var BegetSecretNamespaces = os.Getenv("BEGET_SECRET_NAMESPACES")
+var BegetSecretNamespacesOnly = os.Getenv("BEGET_SECRET_NAMESPACES_ONLY")
+var BegetClusterResourceNamespace = os.Getenv("BEGET_CLUSTER_RESOURCE_NAMESPACE")
+var BegetLogin = os.Getenv("BEGET_LOGIN")
+var BegetLoginFile = os.Getenv("BEGET_LOGIN_FILE")
+var BegetPasswd = os.Getenv("BEGET_PASSWD")
+var BegetPasswdFile = os.Getenv("BEGET_PASSWD_FILE")
+var BegetAuthoritativeNameservers = os.Getenv("BEGET_AUTHORITATIVE_NAMESERVERS")
+var BegetPropagationTimeout = os.Getenv("BEGET_PROPAGATION_TIMEOUT")
+var BegetMetricsAddress = os.Getenv("BEGET_METRICS_ADDRESS")
 
 // beget api doesn't support strict mode with retaining records
 func main() {
@@ -43,85 +75,391 @@ func main() {
 		panic(fmt.Sprintf("failed to parse begetUrl: %s", BegetDnsApiUrl))
 	}
 
-	cmd.RunWebhookServer(GroupName,
-		New(begetUrl),
-	)
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		panic(fmt.Sprintf("failed to set up tracing: %v", err))
+	}
+	defer shutdownTracing(context.Background())
+
+	solver := New(begetUrl, apiClientOptions()...)
+	solver.secretNamespaces = parseNamespaces(BegetSecretNamespaces)
+	solver.clusterResourceNamespace = BegetClusterResourceNamespace
+	if BegetSecretNamespacesOnly != "" {
+		solver.secretNamespacesOnly, err = strconv.ParseBool(BegetSecretNamespacesOnly)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse BEGET_SECRET_NAMESPACES_ONLY: %s", BegetSecretNamespacesOnly))
+		}
+	}
+	solver.metricsAddress = BegetMetricsAddress
+	solver.authoritativeNameservers = parseNameservers(BegetAuthoritativeNameservers)
+	if BegetPropagationTimeout != "" {
+		solver.propagationTimeout = mustParseDuration("BEGET_PROPAGATION_TIMEOUT", BegetPropagationTimeout)
+	}
+	solver.defaultCredentials, err = newDefaultCredentials(BegetLogin, BegetLoginFile, BegetPasswd, BegetPasswdFile)
+	if err != nil {
+		panic(fmt.Sprintf("failed to configure default credentials: %v", err))
+	}
+
+	cmd.RunWebhookServer(GroupName, solver)
+}
+
+// parseNamespaces parses a comma separated list of namespaces, or of pairs of
+// namespaces as "<issuer namespace>:<secret namespace>"
+func parseNamespaces(value string) map[string]bool {
+	namespaces := make(map[string]bool)
+	for _, ns := range strings.Split(value, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces[ns] = true
+		}
+	}
+
+	return namespaces
+}
+
+// apiClientOptions configures the Beget API client from the environment
+func apiClientOptions() []begetapi.Option {
+	var opts []begetapi.Option
+	if BegetApiRequestTimeout != "" {
+		opts = append(opts, begetapi.WithRequestTimeout(mustParseDuration("BEGET_API_REQUEST_TIMEOUT", BegetApiRequestTimeout)))
+	}
+	if BegetApiTimeout != "" {
+		opts = append(opts, begetapi.WithTimeout(mustParseDuration("BEGET_API_TIMEOUT", BegetApiTimeout)))
+	}
+
+	retryPolicy := begetapi.DefaultRetryPolicy()
+	if BegetApiRetryMaxAttempts != "" {
+		attempts, err := strconv.Atoi(BegetApiRetryMaxAttempts)
+		if err != nil || attempts < 1 {
+			panic(fmt.Sprintf("failed to parse BEGET_API_RETRY_MAX_ATTEMPTS: %s", BegetApiRetryMaxAttempts))
+		}
+		retryPolicy.MaxAttempts = attempts
+	}
+	if BegetApiRetryBaseDelay != "" {
+		retryPolicy.BaseDelay = mustParseDuration("BEGET_API_RETRY_BASE_DELAY", BegetApiRetryBaseDelay)
+	}
+	if BegetApiRetryMaxDelay != "" {
+		retryPolicy.MaxDelay = mustParseDuration("BEGET_API_RETRY_MAX_DELAY", BegetApiRetryMaxDelay)
+	}
+	opts = append(opts, begetapi.WithRetryPolicy(retryPolicy))
+
+	if BegetApiRateLimit != "" {
+		limit, err := strconv.ParseFloat(BegetApiRateLimit, 64)
+		if err != nil || limit < 0 {
+			panic(fmt.Sprintf("failed to parse BEGET_API_RATE_LIMIT: %s", BegetApiRateLimit))
+		}
+
+		burst := 1
+		if BegetApiRateBurst != "" {
+			burst, err = strconv.Atoi(BegetApiRateBurst)
+			if err != nil || burst < 1 {
+				panic(fmt.Sprintf("failed to parse BEGET_API_RATE_BURST: %s", BegetApiRateBurst))
+			}
+		}
+
+		opts = append(opts, begetapi.WithRateLimit(limit, burst))
+	}
+
+	return opts
+}
+
+// parseNameservers parses a comma separated list of nameservers, the port
+// defaults to 53
+func parseNameservers(value string) []string {
+	var nameservers []string
+	for _, ns := range strings.Split(value, ",") {
+		ns = strings.TrimSpace(ns)
+		if ns == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			ns = net.JoinHostPort(ns, "53")
+		}
+		nameservers = append(nameservers, ns)
+	}
+
+	return nameservers
+}
+
+func mustParseDuration(name, value string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse %s: %s", name, value))
+	}
+
+	return d
+}
+
+// secretRef is a key of a secret in the namespace of the issuer, or in the
+// cluster resource namespace for a ClusterIssuer, unless Namespace is set
+type secretRef struct {
+	certmgrv1.SecretKeySelector `json:",inline"`
+	// Namespace must be allowed by BEGET_SECRET_NAMESPACES of the webhook
+	Namespace string `json:"namespace,omitempty"`
 }
 
 type begetDNSProviderConfig struct {
-	APILoginSecretRef  certmgrv1.SecretKeySelector `json:"apiLoginSecretRef"`
-	APIPasswdSecretRef certmgrv1.SecretKeySelector `json:"apiPasswdSecretRef"`
+	APILoginSecretRef  secretRef `json:"apiLoginSecretRef"`
+	APIPasswdSecretRef secretRef `json:"apiPasswdSecretRef"`
+	// DeleteCreatedSubdomain removes the challenge subdomain on clean up,
+	// if the solver has created it and no records are left in it
+	DeleteCreatedSubdomain bool `json:"deleteCreatedSubdomain,omitempty"`
+	// DelegationTarget is the name in a beget zone the challenge names of
+	// the issuer are delegated to with a CNAME, the TXT records go there
+	DelegationTarget string `json:"delegationTarget,omitempty"`
+	// FollowCNAME writes the TXT records where the CNAME chain of the
+	// challenge name ends, unless DelegationTarget is set
+	FollowCNAME bool `json:"followCNAME,omitempty"`
+	// VerifyPropagation waits for the TXT record to be served by all the
+	// authoritative nameservers of the name before reporting it presented
+	VerifyPropagation bool `json:"verifyPropagation,omitempty"`
+	// Accounts route the challenges to several beget accounts by domain,
+	// the refs above serve the names none of the accounts selects
+	Accounts []begetAccountConfig `json:"accounts,omitempty"`
 }
 
-func loadConfig(cfgJSON *extapi.JSON) (begetDNSProviderConfig, error) {
+// configPath is where the solver config sits in an issuer
+var configPath = field.NewPath("spec", "acme", "solvers[]", "dns01", "webhook", "config")
+
+// loadConfig decodes and validates the config of the issuer, the secret refs
+// may be left out if the webhook has default credentials
+func loadConfig(cfgJSON *extapi.JSON, haveDefaultCredentials bool) (begetDNSProviderConfig, error) {
 	klog.Info("solver.loadConfig")
 	cfg := begetDNSProviderConfig{}
-	if cfgJSON == nil {
-		klog.Error("solver.loadConfig: empty cfg")
-		return cfg, nil
+	if cfgJSON == nil || len(cfgJSON.Raw) == 0 {
+		if haveDefaultCredentials {
+			return cfg, nil
+		}
+
+		return cfg, fmt.Errorf("invalid solver config: %w", field.Required(configPath, "beget credentials must be configured"))
+	}
+
+	// a misspelled field would otherwise surface as a missing secret much later
+	dec := json.NewDecoder(bytes.NewReader(cfgJSON.Raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("error decoding solver config %s: %v", configPath, err)
 	}
 
-	if err := json.Unmarshal(cfgJSON.Raw, &cfg); err != nil {
-		return cfg, fmt.Errorf("error decoding solver config: %v", err)
+	if errs := validateConfig(&cfg, haveDefaultCredentials); len(errs) > 0 {
+		return cfg, fmt.Errorf("invalid solver config: %w", errs.ToAggregate())
 	}
 
 	return cfg, nil
 }
 
-func (s *Solver) credentials(namespace string, login, password certmgrv1.SecretKeySelector) (begetapi.Credentials, error) {
-	klog.Info("solver.credentials")
-	sec, err := s.k8sClient.CoreV1().
-		Secrets(namespace).
-		Get(context.TODO(), login.Name, v1.GetOptions{})
-	if err != nil {
-		klog.Errorf("solver.credentials: calling k8s: %v", err)
+// validateConfig checks the config and fills the defaults in: the password
+// is looked up in the secret of the login unless its secret is named
+func validateConfig(cfg *begetDNSProviderConfig, haveDefaultCredentials bool) field.ErrorList {
+	var errs field.ErrorList
 
-		return begetapi.Credentials{}, err
+	// the issuer's own refs may be left out if the accounts cover everything
+	// or the default credentials serve the rest
+	optional := len(cfg.Accounts) > 0 || haveDefaultCredentials
+	if !optional || !isEmptySecretRef(cfg.APILoginSecretRef) || !isEmptySecretRef(cfg.APIPasswdSecretRef) {
+		errs = append(errs, validateSecretRefs(&cfg.APILoginSecretRef, &cfg.APIPasswdSecretRef, configPath)...)
 	}
 
-	loginBytes, ok := sec.Data[login.Key]
-	if !ok {
-		return begetapi.Credentials{}, fmt.Errorf("key %q not found in secret \"%s/%s\"",
-			login.Key,
-			login.Name,
-			namespace)
+	errs = append(errs, validateAccounts(cfg.Accounts, configPath.Child("accounts"))...)
+
+	return errs
+}
+
+func validateSecretRefs(login, password *secretRef, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	if login.Name == "" {
+		errs = append(errs, field.Required(path.Child("apiLoginSecretRef", "name"), "name of the secret with the beget login"))
+	}
+	if login.Key == "" {
+		errs = append(errs, field.Required(path.Child("apiLoginSecretRef", "key"), "key of the beget login in the secret"))
+	}
+
+	if password.Name == "" {
+		password.Name = login.Name
+		password.Namespace = login.Namespace
+	}
+	if password.Key == "" {
+		errs = append(errs, field.Required(path.Child("apiPasswdSecretRef", "key"), "key of the beget password in the secret"))
+	}
+
+	for _, ref := range []struct {
+		name string
+		ref  *secretRef
+	}{{"apiLoginSecretRef", login}, {"apiPasswdSecretRef", password}} {
+		if ref.ref.Namespace == "" {
+			continue
+		}
+		for _, msg := range validation.IsDNS1123Label(ref.ref.Namespace) {
+			errs = append(errs, field.Invalid(path.Child(ref.name, "namespace"), ref.ref.Namespace, msg))
+		}
+	}
+
+	return errs
+}
+
+func isEmptySecretRef(ref secretRef) bool {
+	return ref.Name == "" && ref.Key == "" && ref.Namespace == ""
+}
+
+// secretNamespace returns the namespace to read the secret of ref from, only
+// the namespace of the challenge and the allowed ones may be read: otherwise
+// any tenant able to create an issuer could use anybody's credentials
+func (s *Solver) secretNamespace(namespace string, ref secretRef) (string, error) {
+	secretNamespace := ref.Namespace
+	if secretNamespace == "" {
+		secretNamespace = namespace
 	}
 
-	var passwordBytes []byte
+	if !s.maySecretsBeRead(namespace, secretNamespace) {
+		return "", fmt.Errorf("secret \"%s/%s\" may not be used by issuers in namespace %q, "+
+			"BEGET_SECRET_NAMESPACES of the webhook must list \"%s:%s\"", secretNamespace, ref.Name, namespace, namespace, secretNamespace)
+	}
+
+	return secretNamespace, nil
+}
 
-	if login.Name != password.Name {
-		passwdSec, err := s.k8sClient.CoreV1().
-			Secrets(namespace).
-			Get(context.TODO(), password.Name, v1.GetOptions{})
+// maySecretsBeRead reports whether the issuers of namespace may read the
+// secrets of secretNamespace. ClusterIssuers, whose challenges come from the
+// cluster resource namespace, may read the listed namespaces. Other issuers
+// are tenants: they read their own namespace only, unless another one is
+// granted to theirs with an "<issuer namespace>:<secret namespace>" entry.
+func (s *Solver) maySecretsBeRead(namespace, secretNamespace string) bool {
+	if s.secretNamespaces[namespace+":"+secretNamespace] {
+		return true
+	}
+
+	if secretNamespace == namespace {
+		// the webhook may be granted reading secrets of the listed namespaces only
+		return !s.secretNamespacesOnly || s.secretNamespaces[namespace] || namespace == s.clusterResourceNamespace
+	}
+
+	return s.clusterResourceNamespace != "" && namespace == s.clusterResourceNamespace && s.secretNamespaces[secretNamespace]
+}
+
+// accountCredentials are the credentials of a beget account along with where
+// they are read from. Errors name the source, never the login: they end up in
+// the statuses and events of challenges, which tenants may read
+type accountCredentials struct {
+	begetapi.Credentials
+	source string
+}
+
+// credentialsFor returns the credentials of the account serving fqdn: one of
+// the accounts of the issuer, its own secret refs or the default credentials
+func (s *Solver) credentialsFor(ctx context.Context, namespace string, cfg begetDNSProviderConfig, fqdn string) (accountCredentials, error) {
+	if login, password, ok := cfg.accountFor(fqdn); ok {
+		creds, err := s.credentials(ctx, namespace, login, password)
 		if err != nil {
-			return begetapi.Credentials{}, err
+			s.metrics.observeCredentialFailure("secret")
 		}
 
-		passwordBytes, ok = passwdSec.Data[password.Key]
-		if !ok {
-			return begetapi.Credentials{}, fmt.Errorf("key %q not found in secret \"%s/%s\"",
-				password.Key,
-				password.Name,
-				namespace)
+		loginNamespace := login.Namespace
+		if loginNamespace == "" {
+			loginNamespace = namespace
 		}
-	} else {
-		passwordBytes, ok = sec.Data[password.Key]
-		if !ok {
-			return begetapi.Credentials{}, fmt.Errorf("key %q not found in secret \"%s/%s\"",
-				password.Key,
-				password.Name,
-				namespace)
+		source := fmt.Sprintf("secret \"%s/%s\" key %q", loginNamespace, login.Name, login.Key)
+
+		return accountCredentials{Credentials: creds, source: source}, err
+	}
+
+	if s.defaultCredentials != nil {
+		creds, err := s.defaultCredentials.Get()
+		if err != nil {
+			s.metrics.observeCredentialFailure("default")
 		}
+
+		return accountCredentials{Credentials: creds, source: "the default credentials of the webhook"}, err
+	}
+
+	s.metrics.observeCredentialFailure("none")
+
+	return accountCredentials{}, fmt.Errorf("no account of the issuer selects %s, and neither apiLoginSecretRef nor default credentials of the webhook are set", fqdn)
+}
+
+func (s *Solver) credentials(ctx context.Context, namespace string, login, password secretRef) (begetapi.Credentials, error) {
+	klog.Info("solver.credentials")
+	loginBytes, err := s.secretKey(ctx, namespace, login)
+	if err != nil {
+		return begetapi.Credentials{}, err
+	}
+
+	// the secret is already cached if the password is stored along with the login
+	passwordBytes, err := s.secretKey(ctx, namespace, password)
+	if err != nil {
+		return begetapi.Credentials{}, err
 	}
 
 	return begetapi.Credentials{Login: string(loginBytes), Passwd: string(passwordBytes)}, nil
 }
 
+func (s *Solver) secretKey(ctx context.Context, namespace string, ref secretRef) (_ []byte, err error) {
+	namespace, err = s.secretNamespace(namespace, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := s.tracer.Start(ctx, "beget.secret",
+		trace.WithAttributes(semconv.K8SNamespaceName(namespace), attribute.String("k8s.secret.name", ref.Name)))
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
+	sec, err := s.secrets.Get(ctx, namespace, ref.Name)
+	if err != nil {
+		klog.Errorf("solver.credentials: calling k8s: %v", err)
+
+		return nil, err
+	}
+
+	value, ok := sec.Data[ref.Key]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found in secret \"%s/%s\"", ref.Key, namespace, ref.Name)
+	}
+
+	return value, nil
+}
+
 type Solver struct {
 	name      string
 	client    *begetapi.ApiClient
-	k8sClient *kubernetes.Clientset
-	sync.RWMutex
+	k8sClient kubernetes.Interface
+	// finds the Challenges and issuers to record the events of failures on
+	cmClient   cmclient.Interface
+	challenges *challengeCache
+	recorder   record.EventRecorder
+	// the failure events being recorded in the background
+	pendingEvents sync.WaitGroup
+	secrets       *secretCache
+	// records of a name are updated as a whole, so concurrent challenges
+	// on the same name must not interleave their getData/changeRecords
+	recordLocks *keyedMutex
+	// merges the writes of concurrent challenges on a name
+	writes *writeCoalescer
+	stopCh <-chan struct{}
+	// serve the issuers without secret refs, nil if not configured
+	defaultCredentials *defaultCredentials
+	// namespaces besides the challenge's one ClusterIssuers may read secrets
+	// from, and "<issuer namespace>:<secret namespace>" grants to other issuers
+	secretNamespaces map[string]bool
+	// secretNamespacesOnly disallows the challenge's namespace unless listed
+	secretNamespacesOnly bool
+	// the --cluster-resource-namespace of cert-manager, the challenges of
+	// ClusterIssuers are resolved there
+	clusterResourceNamespace string
+	// nameservers to follow CNAMEs with, host:port, the system ones if empty
+	nameservers []string
+	// nameservers to verify propagation against, host:port, looked up if empty
+	authoritativeNameservers []string
+	propagationTimeout       time.Duration
+	metrics                  *metrics
+	tracer                   trace.Tracer
+	// address to serve the metrics on, not served if empty
+	metricsAddress string
+
+	// subdomains created for challenges, by recordLockKey
+	createdSubdomains   map[string]int
+	createdSubdomainsMu sync.Mutex
 }
 
 func (e *Solver) Name() string {
@@ -130,6 +468,24 @@ func (e *Solver) Name() string {
 }
 
 func (e *Solver) Present(ch *acme.ChallengeRequest) error {
+	ctx, cancel := e.challengeContext()
+	defer cancel()
+
+	ctx, span := e.startChallengeSpan(ctx, "present", ch)
+	defer span.End()
+
+	start := time.Now()
+	err := e.present(ctx, ch)
+	e.metrics.observeChallenge("present", time.Since(start), err)
+	if err != nil {
+		recordSpanError(span, err)
+		e.recordFailure(ch, "present", err)
+	}
+
+	return err
+}
+
+func (e *Solver) present(ctx context.Context, ch *acme.ChallengeRequest) error {
 	var chString string
 	if ch != nil {
 		chString = fmt.Sprintf("rn: %s, rz: %s, rfqdn: %s, dnsn: %s", ch.ResourceNamespace, ch.ResolvedZone, ch.ResolvedFQDN, ch.DNSName)
@@ -137,7 +493,7 @@ func (e *Solver) Present(ch *acme.ChallengeRequest) error {
 
 	klog.Infof("solver.present: ch.: %s", chString)
 
-	cfg, err := loadConfig(ch.Config)
+	cfg, err := loadConfig(ch.Config, e.defaultCredentials != nil)
 	if err != nil {
 		klog.Errorf("solver.present: loadConfig: %v", err)
 
@@ -146,34 +502,158 @@ func (e *Solver) Present(ch *acme.ChallengeRequest) error {
 
 	klog.Info("solver.present: after loadConfig")
 
-	creds, err := e.credentials(ch.ResourceNamespace, cfg.APILoginSecretRef, cfg.APIPasswdSecretRef)
+	fqdn, zone, err := e.challengeName(ctx, ch, cfg)
 	if err != nil {
-		klog.Errorf("solver.present: credentials: %v", err)
+		klog.Errorf("solver.present: challengeName: %v", err)
 
 		return err
 	}
 
-	klog.Info("solver.present: after credentials")
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("beget.fqdn", fqdn))
 
-	records := make(begetapi.Records)
+	creds, err := e.credentialsFor(ctx, ch.ResourceNamespace, cfg, fqdn)
+	if err != nil {
+		klog.Errorf("solver.present: credentials: %v", err)
 
-	begetapi.PushTXTRecord(records, ch.Key)
+		return err
+	}
 
-	klog.Info("solver.present: before changeRecords")
+	klog.Info("solver.present: after credentials")
 
-	err = e.client.ChangeRecords(trimFqdn(ch.ResolvedFQDN), records, creds)
+	err = e.presentRecord(ctx, creds, fqdn, zone, ch.Key)
 	if err != nil {
-		klog.Errorf("solver.present: changeRecords err: %v", err)
-
-		return fmt.Errorf("changing DNS records via API: %w", err)
+		return err
 	}
 
-	klog.Infof("solver.present client.changeRecords")
+	if cfg.VerifyPropagation {
+		// the name is unlocked by now, other challenges of it don't wait
+		err = e.waitForPropagation(ctx, fqdn, ch.Key)
+		if err != nil {
+			klog.Errorf("solver.present: waitForPropagation: %v", err)
+
+			return err
+		}
+	}
 
 	return nil
 }
 
+// presentRecord adds the TXT record of the challenge key to the name
+func (e *Solver) presentRecord(ctx context.Context, creds accountCredentials, fqdn, zone, key string) error {
+	_, err := e.writes.Submit(ctx, recordLockKey(creds.Credentials, fqdn), txtChange{value: key, zone: zone}, e.flushTXT(creds, fqdn))
+
+	return err
+}
+
+// flushTXT returns the write of the TXT changes of the name, it's called with the name locked
+func (e *Solver) flushTXT(creds accountCredentials, fqdn string) flushFunc {
+	return func(ctx context.Context, changes []txtChange) (begetapi.Records, []error, error) {
+		var adds, deleteSubdomain bool
+		var zone string
+		for _, change := range changes {
+			adds = adds || !change.remove
+			deleteSubdomain = deleteSubdomain || change.deleteSubdomain
+			if zone == "" && !change.remove {
+				zone = change.zone
+			}
+		}
+
+		// changeRecords replaces the whole set of the name, so the challenge
+		// keys are merged into the existing records instead of overwriting them
+		records, err := e.client.GetDataContext(ctx, fqdn, creds.Credentials)
+		if begetapi.IsNotFound(err) {
+			if !adds {
+				klog.Infof("solver.flushTXT: %s is not found, nothing to remove", fqdn)
+
+				return begetapi.Records{}, nil, nil
+			}
+
+			// beget keeps records of known names only
+			err = e.ensureName(ctx, creds, fqdn, zone)
+			if err != nil {
+				klog.Errorf("solver.flushTXT: ensureName err: %v", err)
+
+				return begetapi.Records{}, nil, fmt.Errorf("preparing the challenge name via API: %w", explainAPIError(creds.source, err))
+			}
+
+			records, err = e.client.GetDataContext(ctx, fqdn, creds.Credentials)
+		}
+		if err != nil {
+			klog.Errorf("solver.flushTXT: getData err: %v", err)
+
+			return begetapi.Records{}, nil, fmt.Errorf("getting DNS records via API: %w", explainAPIError(creds.source, err))
+		}
+
+		// other challenges may share the name (wildcard and apex), so only
+		// the values of these challenges are added and removed
+		changed := false
+		var rejected []error
+		for i, change := range changes {
+			if change.remove {
+				changed = begetapi.PopTXTRecordByValue(&records, change.value) > 0 || changed
+
+				continue
+			}
+
+			n := len(records.TXT)
+			err = begetapi.PushTXTRecord(&records, change.value)
+			if err != nil {
+				// the other challenges of the name don't fail with it
+				if rejected == nil {
+					rejected = make([]error, len(changes))
+				}
+				rejected[i] = fmt.Errorf("adding TXT record: %w", err)
+
+				continue
+			}
+			changed = len(records.TXT) != n || changed
+		}
+
+		if !changed {
+			klog.Infof("solver.flushTXT: TXT records of %s are up to date", fqdn)
+
+			return records, rejected, nil
+		}
+
+		err = e.client.ChangeRecordsContext(ctx, fqdn, records, creds.Credentials)
+		if err != nil {
+			klog.Errorf("solver.flushTXT: changeRecords err: %v", err)
+
+			return begetapi.Records{}, nil, fmt.Errorf("changing DNS records via API: %w", explainAPIError(creds.source, err))
+		}
+
+		klog.Infof("solver.flushTXT: %d changes of %s are written", len(changes), fqdn)
+
+		if deleteSubdomain && records.IsEmpty() {
+			err = e.deleteCreatedSubdomain(ctx, creds, fqdn)
+			if err != nil {
+				return records, nil, fmt.Errorf("deleting the challenge subdomain via API: %w", explainAPIError(creds.source, err))
+			}
+		}
+
+		return records, rejected, nil
+	}
+}
+
 func (e *Solver) CleanUp(ch *acme.ChallengeRequest) error {
+	ctx, cancel := e.challengeContext()
+	defer cancel()
+
+	ctx, span := e.startChallengeSpan(ctx, "cleanup", ch)
+	defer span.End()
+
+	start := time.Now()
+	err := e.cleanUp(ctx, ch)
+	e.metrics.observeChallenge("cleanup", time.Since(start), err)
+	if err != nil {
+		recordSpanError(span, err)
+		e.recordFailure(ch, "cleanup", err)
+	}
+
+	return err
+}
+
+func (e *Solver) cleanUp(ctx context.Context, ch *acme.ChallengeRequest) error {
 	var chString string
 	if ch != nil {
 		chString = fmt.Sprintf("rn: %s, rz: %s, rfqdn: %s, dnsn: %s", ch.ResourceNamespace, ch.ResolvedZone, ch.ResolvedFQDN, ch.DNSName)
@@ -181,27 +661,205 @@ func (e *Solver) CleanUp(ch *acme.ChallengeRequest) error {
 
 	klog.Infof("solver.cleanUp ch.: %s", chString)
 
-	cfg, err := loadConfig(ch.Config)
+	cfg, err := loadConfig(ch.Config, e.defaultCredentials != nil)
+	if err != nil {
+		return err
+	}
+	fqdn, _, err := e.challengeName(ctx, ch, cfg)
+	if err != nil {
+		return err
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("beget.fqdn", fqdn))
+
+	creds, err := e.credentialsFor(ctx, ch.ResourceNamespace, cfg, fqdn)
+	if err != nil {
+		return err
+	}
+
+	change := txtChange{value: ch.Key, remove: true, deleteSubdomain: cfg.DeleteCreatedSubdomain}
+	_, err = e.writes.Submit(ctx, recordLockKey(creds.Credentials, fqdn), change, e.flushTXT(creds, fqdn))
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("solver.cleanUp: TXT record of %s is removed", fqdn)
+
+	return nil
+}
+
+// challengeName returns the name the TXT record of the challenge is written
+// to and the zone cert-manager has resolved for it, empty if unknown
+func (e *Solver) challengeName(ctx context.Context, ch *acme.ChallengeRequest, cfg begetDNSProviderConfig) (string, string, error) {
+	fqdn := trimFqdn(ch.ResolvedFQDN)
+
+	if cfg.DelegationTarget != "" {
+		klog.Infof("solver.challengeName: %s is delegated to %s", fqdn, cfg.DelegationTarget)
+
+		return trimFqdn(cfg.DelegationTarget), "", nil
+	}
+
+	if cfg.FollowCNAME {
+		target, err := e.followCNAME(ctx, fqdn)
+		if err != nil {
+			return "", "", fmt.Errorf("following CNAME of the challenge name: %w", err)
+		}
+
+		if target != fqdn {
+			return target, "", nil
+		}
+	}
+
+	return fqdn, trimFqdn(ch.ResolvedZone), nil
+}
+
+// ensureName adds the name as a subdomain of the account's domain owning it,
+// unless it already exists: beget keeps records of known names only. Names
+// are compared case-insensitively, as beget does
+func (e *Solver) ensureName(ctx context.Context, creds accountCredentials, fqdn, zone string) error {
+	domains, err := e.client.GetDomainListContext(ctx, creds.Credentials)
 	if err != nil {
 		return err
 	}
-	creds, err := e.credentials(ch.ResourceNamespace, cfg.APILoginSecretRef, cfg.APIPasswdSecretRef)
+
+	domain, ok := owningDomain(domains, fqdn, zone)
+	if !ok {
+		return &unknownDomainError{source: creds.source, fqdn: fqdn, zones: candidateZones(fqdn, zone)}
+	}
+
+	if strings.EqualFold(domain.FQDN, fqdn) {
+		return nil
+	}
+
+	subdomains, err := e.client.GetSubdomainListContext(ctx, creds.Credentials)
 	if err != nil {
 		return err
 	}
 
-	records := make(begetapi.Records)
+	for _, sub := range subdomains {
+		if strings.EqualFold(sub.FQDN, fqdn) {
+			return nil
+		}
+	}
 
-	err = e.client.ChangeRecords(trimFqdn(ch.ResolvedFQDN), records, creds)
+	// the domain is a suffix of the name, though maybe in other case
+	subdomain := fqdn[:len(fqdn)-len(domain.FQDN)-1]
+
+	id, err := e.client.AddSubdomainVirtualContext(ctx, subdomain, domain.ID, creds.Credentials)
 	if err != nil {
-		return fmt.Errorf("changing DNS records via API: %w", err)
+		return err
+	}
+
+	klog.Infof("solver.ensureName: created subdomain %s (%d)", fqdn, id)
+
+	e.createdSubdomainsMu.Lock()
+	e.createdSubdomains[recordLockKey(creds.Credentials, fqdn)] = id
+	e.createdSubdomainsMu.Unlock()
+
+	return nil
+}
+
+// deleteCreatedSubdomain deletes the name if ensureName has created it
+func (e *Solver) deleteCreatedSubdomain(ctx context.Context, creds accountCredentials, fqdn string) error {
+	key := recordLockKey(creds.Credentials, fqdn)
+
+	e.createdSubdomainsMu.Lock()
+	id, ok := e.createdSubdomains[key]
+	e.createdSubdomainsMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	err := e.client.DeleteSubdomainContext(ctx, id, creds.Credentials)
+	if err != nil && !begetapi.IsNotFound(err) {
+		return err
 	}
 
-	klog.Infof("solver.cleanUp client.changeRecords")
+	klog.Infof("solver.deleteCreatedSubdomain: deleted subdomain %s (%d)", fqdn, id)
+
+	e.createdSubdomainsMu.Lock()
+	delete(e.createdSubdomains, key)
+	e.createdSubdomainsMu.Unlock()
 
 	return nil
 }
 
+// unknownDomainError is returned when none of the zones of a name is a domain of the account
+type unknownDomainError struct {
+	// source of the credentials of the account
+	source string
+	fqdn   string
+	zones  []string
+}
+
+func (e *unknownDomainError) Error() string {
+	return fmt.Sprintf("no domain of the beget account of %s covers %s, none of the zones %s is added in the beget panel",
+		e.source, e.fqdn, strings.Join(e.zones, ", "))
+}
+
+// owningDomain returns the domain the name belongs to: the zone cert-manager
+// resolved for the challenge if the account has it, or the most specific
+// domain of the account covering the name otherwise
+func owningDomain(domains []begetapi.Domain, fqdn, zone string) (begetapi.Domain, bool) {
+	if zone != "" && inZone(fqdn, zone) {
+		for _, d := range domains {
+			if strings.EqualFold(d.FQDN, zone) {
+				return d, true
+			}
+		}
+	}
+
+	var owner begetapi.Domain
+	for _, d := range domains {
+		if inZone(fqdn, d.FQDN) && len(d.FQDN) > len(owner.FQDN) {
+			owner = d
+		}
+	}
+
+	return owner, owner.FQDN != ""
+}
+
+// candidateZones lists the zones a domain owning the name may have,
+// the resolved zone goes first
+func candidateZones(fqdn, zone string) []string {
+	var zones []string
+	if zone != "" {
+		zones = append(zones, zone)
+	}
+
+	labels := strings.Split(fqdn, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		parent := strings.Join(labels[i:], ".")
+		if !strings.EqualFold(parent, zone) {
+			zones = append(zones, parent)
+		}
+	}
+
+	return zones
+}
+
+func inZone(fqdn, zone string) bool {
+	fqdn, zone = strings.ToLower(fqdn), strings.ToLower(zone)
+
+	return fqdn == zone || strings.HasSuffix(fqdn, "."+zone)
+}
+
+// explainAPIError tells what to do about the API errors a user can act upon,
+// the account is named by the source of its credentials
+func explainAPIError(source string, err error) error {
+	switch {
+	case begetapi.IsAuthFailed(err):
+		return fmt.Errorf("beget rejected the credentials of %s, check the secrets referenced by the issuer: %w", source, err)
+	case begetapi.IsRateLimited(err):
+		return fmt.Errorf("request limit of the beget account of %s is exceeded, the challenge will be retried: %w", source, err)
+	case begetapi.IsNotFound(err):
+		return fmt.Errorf("the name is not found in the beget account of %s, it must be added in the beget panel: %w", source, err)
+	}
+
+	return err
+}
+
 func (e *Solver) Initialize(kubeClientConfig *rest.Config, stopCh <-chan struct{}) error {
 	klog.Infof("solver.initialize kcc")
 
@@ -214,18 +872,72 @@ func (e *Solver) Initialize(kubeClientConfig *rest.Config, stopCh <-chan struct{
 		return err
 	}
 
-	e.k8sClient = cl
+	cmClient, err := cmclient.NewForConfig(kubeClientConfig)
+	if err != nil {
+		return err
+	}
+
+	e.setKubeClient(cl, stopCh)
+	e.setCMClient(cmClient)
+
+	if e.metricsAddress != "" {
+		go e.metrics.serveMetrics(e.metricsAddress, stopCh)
+	}
 
 	return nil
 }
 
-func New(begetURL *url.URL) *Solver {
+func (e *Solver) setKubeClient(cl kubernetes.Interface, stopCh <-chan struct{}) {
+	e.k8sClient = cl
+	e.secrets = newSecretCache(cl, stopCh)
+	e.recorder = newEventRecorder(cl, stopCh)
+	e.stopCh = stopCh
+}
+
+func (e *Solver) setCMClient(cl cmclient.Interface) {
+	e.cmClient = cl
+	e.challenges = newChallengeCache(cl, e.stopCh)
+}
+
+// challengeContext bounds the handling of a challenge request by the lifetime
+// of the webhook request and of the webhook itself
+func (e *Solver) challengeContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookRequestTimeout)
+	if e.stopCh != nil {
+		go func() {
+			select {
+			case <-e.stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	return ctx, cancel
+}
+
+func New(begetURL *url.URL, opts ...begetapi.Option) *Solver {
+	m := newMetrics()
+	locks := newKeyedMutex()
+
 	return &Solver{
-		name:   "beget",
-		client: begetapi.NewApiClient(begetURL),
+		name:        "beget",
+		client:      begetapi.NewApiClient(begetURL, append([]begetapi.Option{begetapi.WithObserver(m)}, opts...)...),
+		recordLocks: locks,
+		writes:      newWriteCoalescer(locks),
+		metrics:     m,
+		tracer:      otel.Tracer(tracerName),
+
+		createdSubdomains: make(map[string]int),
 	}
 }
 
 func trimFqdn(fqdn string) string {
 	return strings.Trim(fqdn, ".")
 }
+
+// recordLockKey returns the key of the records of the name, names are
+// compared the way beget does: case-insensitively and without the root dot
+func recordLockKey(creds begetapi.Credentials, fqdn string) string {
+	return creds.Login + "/" + strings.ToLower(strings.TrimSuffix(fqdn, "."))
+}
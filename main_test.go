@@ -2,50 +2,484 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
 	"net/url"
-	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
-	dns "github.com/cert-manager/cert-manager/test/acme"
+	acme "github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	certmgrv1 "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	miekgdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
-var (
-	zone = os.Getenv("TEST_ZONE_NAME")
-)
+func TestSolver_Present_KeepsOtherRecords(t *testing.T) {
+	solver, api, mock := newTestSolverWithMock(t)
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	_, err := mock.AddSubdomain("_acme-challenge.example.com")
+	require.NoError(t, err)
+
+	err = api.ChangeRecords("_acme-challenge.example.com", begetapi.Records{
+		A:   []begetapi.ARecord{{Address: "127.0.0.1"}},
+		MX:  []begetapi.MXRecord{{Exchange: "mx.example.com", Preference: 10}},
+		TXT: []begetapi.TXTRecord{{TXTData: "v=spf1 -all"}},
+	}, creds)
+	require.NoError(t, err)
+
+	err = solver.Present(newTestChallenge(t, "_acme-challenge.example.com.", "challenge"))
+	require.NoError(t, err)
+
+	records, err := api.GetData("_acme-challenge.example.com", creds)
+	require.NoError(t, err)
+	require.Len(t, records.A, 1)
+	require.Len(t, records.MX, 1)
+	require.Len(t, records.TXT, 2)
+	require.Equal(t, "v=spf1 -all", records.TXT[0].TXTData)
+	require.Equal(t, "challenge", records.TXT[1].TXTData)
+}
+
+func TestSolver_CleanUp_KeepsOtherChallenges(t *testing.T) {
+	solver, api := newTestSolver(t)
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	require.NoError(t, solver.Present(newTestChallenge(t, "_acme-challenge.example.com.", "apex")))
+	require.NoError(t, solver.Present(newTestChallenge(t, "_acme-challenge.example.com.", "wildcard")))
+
+	require.NoError(t, solver.CleanUp(newTestChallenge(t, "_acme-challenge.example.com.", "wildcard")))
+
+	records, err := api.GetData("_acme-challenge.example.com", creds)
+	require.NoError(t, err)
+	require.Len(t, records.TXT, 1)
+	require.Equal(t, "apex", records.TXT[0].TXTData)
+
+	require.NoError(t, solver.CleanUp(newTestChallenge(t, "_acme-challenge.example.com.", "apex")))
+	require.NoError(t, solver.CleanUp(newTestChallenge(t, "_acme-challenge.example.com.", "apex")))
+
+	records, err = api.GetData("_acme-challenge.example.com", creds)
+	require.NoError(t, err)
+	require.Empty(t, records.TXT)
+}
 
-func TestRunsSuite(t *testing.T) {
-	// The manifest path should contain a file named config.json that is a
-	// snippet of valid configuration that should be included on the
-	// ChallengeRequest passed as part of the test cases.
-	begerURL, err := url.Parse("http://localhost:8080")
-	if err != nil {
-		t.FailNow()
+func TestSolver_ConcurrentChallenges(t *testing.T) {
+	solver, api := newTestSolver(t)
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+
+	const challenges = 20
+	run := func(action func(*acme.ChallengeRequest) error) {
+		var wg sync.WaitGroup
+		errs := make(chan error, challenges)
+		for i := 0; i < challenges; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- action(newTestChallenge(t, "_acme-challenge.example.com.", fmt.Sprintf("key-%d", i)))
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
 	}
 
-	api := begetapi.NewBegetApiMock("login", "password")
+	run(solver.Present)
+
+	records, err := api.GetData("_acme-challenge.example.com", creds)
+	require.NoError(t, err)
+	require.Len(t, records.TXT, challenges)
+
+	run(solver.CleanUp)
+
+	records, err = api.GetData("_acme-challenge.example.com", creds)
+	require.NoError(t, err)
+	require.Empty(t, records.TXT)
+	require.Empty(t, solver.recordLocks.locks)
+}
+
+func TestSolver_APIErrors(t *testing.T) {
+	solver, _, mock := newTestSolverWithMock(t)
+
+	mock.FailNext(1, http.StatusOK, `{"status":"error","error_text":"No such user","error_code":"AUTH_ERROR"}`)
+	err := solver.Present(newTestChallenge(t, "_acme-challenge.example.com.", "challenge"))
+	require.ErrorContains(t, err, `beget rejected the credentials of secret "default/beget-credentials" key "login"`)
+	require.True(t, begetapi.IsAuthFailed(err))
+
+	mock.FailNext(1, http.StatusOK, fmt.Sprintf(begetapi.ErrTemplate, "success", "error", "METHOD_FAILED", `"Failed to get DNS\nrecords"`))
+	err = solver.CleanUp(newTestChallenge(t, "_acme-challenge.example.com.", "challenge"))
+	require.NoError(t, err)
+}
+
+func TestSolver_CreatesSubdomain(t *testing.T) {
+	solver, _, mock := newTestSolverWithMock(t)
+	cfg := testConfig()
+	cfg.DeleteCreatedSubdomain = true
+
+	require.NoError(t, solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.www.example.com.", "apex", cfg)))
+	require.NoError(t, solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.www.example.com.", "wildcard", cfg)))
+	require.True(t, mock.HasName("_acme-challenge.www.example.com"))
+
+	require.NoError(t, solver.CleanUp(newTestChallengeWithConfig(t, "_acme-challenge.www.example.com.", "apex", cfg)))
+	require.True(t, mock.HasName("_acme-challenge.www.example.com"), "the subdomain still holds a challenge")
+
+	require.NoError(t, solver.CleanUp(newTestChallengeWithConfig(t, "_acme-challenge.www.example.com.", "wildcard", cfg)))
+	require.False(t, mock.HasName("_acme-challenge.www.example.com"))
+
+	// not created by the solver
+	_, err := mock.AddSubdomain("_acme-challenge.example.com")
+	require.NoError(t, err)
+
+	require.NoError(t, solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.example.com.", "apex", cfg)))
+	require.NoError(t, solver.CleanUp(newTestChallengeWithConfig(t, "_acme-challenge.example.com.", "apex", cfg)))
+	require.True(t, mock.HasName("_acme-challenge.example.com"))
+
+	// kept unless configured otherwise
+	require.NoError(t, solver.Present(newTestChallenge(t, "_acme-challenge.api.example.com.", "apex")))
+	require.NoError(t, solver.CleanUp(newTestChallenge(t, "_acme-challenge.api.example.com.", "apex")))
+	require.True(t, mock.HasName("_acme-challenge.api.example.com"))
+}
+
+func TestSolver_Present_APICalls(t *testing.T) {
+	solver, _, mock := newTestSolverWithMock(t)
+
+	// a known name takes getData and changeRecords only
+	_, err := mock.AddSubdomain("_acme-challenge.example.com")
+	require.NoError(t, err)
+	calls := mock.Calls()
+	require.NoError(t, solver.Present(newTestChallenge(t, "_acme-challenge.example.com.", "challenge")))
+	require.Equal(t, 2, mock.Calls()-calls)
+
+	// names are compared case-insensitively
+	calls = mock.Calls()
+	require.NoError(t, solver.Present(newTestChallenge(t, "_acme-challenge.WWW.Example.com.", "challenge")))
+	require.True(t, mock.HasName("_acme-challenge.www.example.com"))
+	require.False(t, mock.HasName("_acme-challenge.www.example.com.example.com"))
+	require.Equal(t, 6, mock.Calls()-calls, "getData, domain and subdomain lists, addSubdomainVirtual, getData, changeRecords")
+}
+
+func TestSolver_Present_UnknownDomain(t *testing.T) {
+	solver, _ := newTestSolver(t)
+
+	ch := newTestChallenge(t, "_acme-challenge.www.example.org.", "challenge")
+	ch.ResolvedZone = "example.org."
+
+	err := solver.Present(ch)
+	require.ErrorContains(t, err, `no domain of the beget account of secret "default/beget-credentials" key "login" covers _acme-challenge.www.example.org, `+
+		`none of the zones example.org, www.example.org is added in the beget panel`)
+}
+
+func TestSolver_Present_ResolvedZone(t *testing.T) {
+	solver, api, mock := newTestSolverWithMock(t)
+	creds := begetapi.Credentials{Login: "login", Passwd: "password"}
+	wwwID := mock.AddDomain("www.example.com")
+
+	// cert-manager found the zone of the name to be example.com
+	require.NoError(t, solver.Present(newTestChallenge(t, "_acme-challenge.www.example.com.", "challenge")))
+
+	// no zone matches the account, the most specific domain is used
+	ch := newTestChallenge(t, "_acme-challenge.api.www.example.com.", "challenge")
+	ch.ResolvedZone = "api.www.example.com."
+	require.NoError(t, solver.Present(ch))
+
+	subdomains, err := api.GetSubdomainList(creds)
+	require.NoError(t, err)
+	require.Len(t, subdomains, 2)
+	require.Equal(t, "_acme-challenge.www.example.com", subdomains[0].FQDN)
+	require.NotEqual(t, wwwID, subdomains[0].DomainID)
+	require.Equal(t, "_acme-challenge.api.www.example.com", subdomains[1].FQDN)
+	require.Equal(t, wwwID, subdomains[1].DomainID)
+}
+
+func TestLoadConfig(t *testing.T) {
+	for name, tc := range map[string]struct {
+		raw string
+		err string
+	}{
+		"valid": {
+			raw: `{"apiLoginSecretRef":{"name":"creds","key":"login"},"apiPasswdSecretRef":{"name":"creds","key":"passwd"}}`,
+		},
+		"missing": {
+			err: "spec.acme.solvers[].dns01.webhook.config: Required value",
+		},
+		"unknown field": {
+			raw: `{"apiLoginSecret":{"name":"creds","key":"login"},"apiPasswdSecretRef":{"name":"creds","key":"passwd"}}`,
+			err: `json: unknown field "apiLoginSecret"`,
+		},
+		"missing keys": {
+			raw: `{"apiLoginSecretRef":{"name":"creds"},"apiPasswdSecretRef":{}}`,
+			err: "[spec.acme.solvers[].dns01.webhook.config.apiLoginSecretRef.key: Required value: key of the beget login in the secret, " +
+				"spec.acme.solvers[].dns01.webhook.config.apiPasswdSecretRef.key: Required value: key of the beget password in the secret]",
+		},
+		"missing login name": {
+			raw: `{"apiLoginSecretRef":{"key":"login"},"apiPasswdSecretRef":{"key":"passwd"}}`,
+			err: "spec.acme.solvers[].dns01.webhook.config.apiLoginSecretRef.name: Required value",
+		},
+		"accounts only": {
+			raw: `{"accounts":[{"apiLoginSecretRef":{"name":"a","key":"login"},"apiPasswdSecretRef":{"key":"passwd"},"domains":["example.com"]},` +
+				`{"apiLoginSecretRef":{"name":"b","key":"login"},"apiPasswdSecretRef":{"key":"passwd"},"domains":["sub.example.com","example.org"]}]}`,
+		},
+		"account without secret": {
+			raw: `{"accounts":[{"apiPasswdSecretRef":{"key":"passwd"},"domains":["example.com"]}]}`,
+			err: "spec.acme.solvers[].dns01.webhook.config.accounts[0].apiLoginSecretRef.name: Required value",
+		},
+		"same selector": {
+			raw: `{"accounts":[{"apiLoginSecretRef":{"name":"a","key":"login"},"apiPasswdSecretRef":{"key":"passwd"},"domains":["example.com"]},` +
+				`{"apiLoginSecretRef":{"name":"b","key":"login"},"apiPasswdSecretRef":{"key":"passwd"},"domains":["Example.com."]}]}`,
+			err: `spec.acme.solvers[].dns01.webhook.config.accounts[1].domains[0]: Invalid value: "Example.com.": ` +
+				`already selected by spec.acme.solvers[].dns01.webhook.config.accounts[0]`,
+		},
+		"no selectors": {
+			raw: `{"accounts":[{"apiLoginSecretRef":{"name":"a","key":"login"},"apiPasswdSecretRef":{"key":"passwd"}}]}`,
+			err: "spec.acme.solvers[].dns01.webhook.config.accounts[0].domains: Required value",
+		},
+		"empty selector": {
+			raw: `{"accounts":[{"apiLoginSecretRef":{"name":"a","key":"login"},"apiPasswdSecretRef":{"key":"passwd"},"domains":["."]}]}`,
+			err: `spec.acme.solvers[].dns01.webhook.config.accounts[0].domains[0]: Invalid value: ".": empty domain`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var cfgJSON *extapi.JSON
+			if tc.raw != "" {
+				cfgJSON = &extapi.JSON{Raw: []byte(tc.raw)}
+			}
+
+			_, err := loadConfig(cfgJSON, false)
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_DefaultsPasswordSecret(t *testing.T) {
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{
+		"apiLoginSecretRef": {"name": "creds", "key": "login"},
+		"apiPasswdSecretRef": {"key": "passwd"},
+		"accounts": [{
+			"apiLoginSecretRef": {"name": "other", "key": "login"},
+			"apiPasswdSecretRef": {"key": "passwd"},
+			"domains": ["example.org"]
+		}]
+	}`)}, false)
+	require.NoError(t, err)
+	require.Equal(t, "creds", cfg.APIPasswdSecretRef.Name)
+	require.Equal(t, "other", cfg.Accounts[0].APIPasswdSecretRef.Name)
+}
+
+func TestSolver_SecretNamespaces(t *testing.T) {
+	solver, _ := newTestSolver(t)
+	solver.secretNamespaces = parseNamespaces(" shared , apps:shared, ")
+	solver.clusterResourceNamespace = "cert-manager"
+
+	for _, ns := range []string{"shared", "private", "cert-manager"} {
+		_, err := solver.k8sClient.CoreV1().Secrets(ns).Create(context.TODO(), &corev1.Secret{
+			ObjectMeta: v1.ObjectMeta{Name: "beget-credentials", Namespace: ns},
+			Data: map[string][]byte{
+				"login":  []byte(ns),
+				"passwd": []byte("password"),
+			},
+		}, v1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	login := testSecretRef("beget-credentials", "login")
+	passwd := testSecretRef("beget-credentials", "passwd")
+
+	creds, err := solver.credentials(context.TODO(), "default", login, passwd)
+	require.NoError(t, err)
+	require.Equal(t, "login", creds.Login)
+
+	// ClusterIssuers may read the listed namespaces
+	login.Namespace = "shared"
+	creds, err = solver.credentials(context.TODO(), "cert-manager", login, passwd)
+	require.NoError(t, err)
+	require.Equal(t, begetapi.Credentials{Login: "shared", Passwd: "password"}, creds)
+
+	// Issuers only if the listed namespace is granted to theirs
+	value, err := solver.secretKey(context.TODO(), "apps", login)
+	require.NoError(t, err)
+	require.Equal(t, "shared", string(value))
+
+	_, err = solver.credentials(context.TODO(), "default", login, passwd)
+	require.ErrorContains(t, err, `secret "shared/beget-credentials" may not be used by issuers in namespace "default", `+
+		`BEGET_SECRET_NAMESPACES of the webhook must list "default:shared"`)
+
+	// the credentials of ClusterIssuers are out of reach of Issuers
+	login.Namespace = "cert-manager"
+	_, err = solver.credentials(context.TODO(), "default", login, passwd)
+	require.ErrorContains(t, err, `secret "cert-manager/beget-credentials" may not be used by issuers in namespace "default"`)
+
+	// an issuer in the namespace of the secret needs no allowance
+	login.Namespace = "private"
+	creds, err = solver.credentials(context.TODO(), "private", login, passwd)
+	require.NoError(t, err)
+	require.Equal(t, "private", creds.Login)
+
+	_, err = solver.credentials(context.TODO(), "default", login, passwd)
+	require.ErrorContains(t, err, `secret "private/beget-credentials" may not be used by issuers in namespace "default"`)
+
+	_, err = solver.credentials(context.TODO(), "cert-manager", login, passwd)
+	require.ErrorContains(t, err, `secret "private/beget-credentials" may not be used by issuers in namespace "cert-manager"`)
+
+	// the password is looked up next to the login by default
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{
+		"apiLoginSecretRef": {"name": "beget-credentials", "key": "login", "namespace": "shared"},
+		"apiPasswdSecretRef": {"key": "passwd"}
+	}`)}, false)
+	require.NoError(t, err)
+	require.Equal(t, "shared", cfg.APIPasswdSecretRef.Namespace)
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{
+		"apiLoginSecretRef": {"name": "beget-credentials", "key": "login", "namespace": "Shared_NS"},
+		"apiPasswdSecretRef": {"key": "passwd"}
+	}`)}, false)
+	require.ErrorContains(t, err, `spec.acme.solvers[].dns01.webhook.config.apiLoginSecretRef.namespace: Invalid value: "Shared_NS"`)
+
+	// with namespaced RBAC the webhook can't read secrets of unlisted namespaces
+	solver.secretNamespacesOnly = true
+	login.Namespace = ""
+	_, err = solver.credentials(context.TODO(), "private", login, passwd)
+	require.ErrorContains(t, err, `secret "private/beget-credentials" may not be used by issuers in namespace "private"`)
+
+	for _, ns := range []string{"shared", "cert-manager"} {
+		creds, err = solver.credentials(context.TODO(), ns, login, passwd)
+		require.NoError(t, err)
+		require.Equal(t, ns, creds.Login)
+	}
+}
+
+// startTestDNS runs the DNS server of the mock on a free port until the test
+// ends and returns its address
+func startTestDNS(t *testing.T, mock *begetapi.BegetApiMock) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := conn.LocalAddr().String()
+
+	served := make(chan error, 1)
 	go func() {
-		api.Run(":8080")
-		t.Log("run")
+		served <- mock.ServeDns(conn)
 	}()
+	t.Cleanup(func() {
+		mock.StopDns(context.TODO())
+	})
+
+	// StopDns can't stop a server that isn't started yet, wait for its answer
+	msg := new(miekgdns.Msg)
+	msg.SetQuestion("example.com.", miekgdns.TypeNS)
+	for i := 0; i < 50; i++ {
+		select {
+		case err := <-served:
+			require.NoError(t, err, "running the mock dns")
+		default:
+		}
+
+		_, err = miekgdns.Exchange(msg, addr)
+		if err == nil {
+			return addr
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NoError(t, err)
+
+	return addr
+}
+
+// startTestAPI serves the API of the mock on a free port until the test ends
+// and returns its URL
+func startTestAPI(t *testing.T, mock *begetapi.BegetApiMock) *url.URL {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
 	go func() {
-		api.RunDns("59351")
-		t.Log("run dns")
-	}()
-	defer func() {
-		api.Stop(context.TODO())
-		api.StopDns(context.TODO())
-		t.Log("stopped servers")
+		mock.Serve(l)
 	}()
+	t.Cleanup(func() {
+		mock.Stop(context.TODO())
+		http.DefaultClient.CloseIdleConnections()
+	})
 
-	solver := New(begerURL)
-	fixture := dns.NewFixture(solver,
-		dns.SetResolvedZone("example.com."),
-		dns.SetManifestPath("testdata/beget"),
-		dns.SetDNSServer("127.0.0.1:59351"),
-		dns.SetUseAuthoritative(false),
-	)
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// newTestSolver returns a solver talking to a started mock, and a client for
+// inspecting the mock's state directly
+func newTestSolver(t *testing.T, opts ...begetapi.Option) (*Solver, *begetapi.ApiClient) {
+	t.Helper()
 
-	fixture.RunConformance(t)
+	solver, api, _ := newTestSolverWithMock(t, opts...)
 
+	return solver, api
+}
+
+func newTestSolverWithMock(t *testing.T, opts ...begetapi.Option) (*Solver, *begetapi.ApiClient, *begetapi.BegetApiMock) {
+	t.Helper()
+
+	mock := begetapi.NewBegetApiMock("login", "password")
+	mock.AddDomain("example.com")
+	apiURL := startTestAPI(t, mock)
+	solverURL := *apiURL
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() {
+		close(stopCh)
+	})
+
+	solver := New(&solverURL, opts...)
+	solver.setKubeClient(fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "beget-credentials", Namespace: "default"},
+		Data: map[string][]byte{
+			"login":  []byte("login"),
+			"passwd": []byte("password"),
+		},
+	}), stopCh)
+
+	return solver, begetapi.NewApiClient(apiURL), mock
+}
+
+func testConfig() begetDNSProviderConfig {
+	return begetDNSProviderConfig{
+		APILoginSecretRef:  testSecretRef("beget-credentials", "login"),
+		APIPasswdSecretRef: testSecretRef("beget-credentials", "passwd"),
+	}
+}
+
+func testSecretRef(name, key string) secretRef {
+	return secretRef{SecretKeySelector: certmgrv1.SecretKeySelector{LocalObjectReference: certmgrv1.LocalObjectReference{Name: name}, Key: key}}
+}
+
+func newTestChallenge(t *testing.T, fqdn, key string) *acme.ChallengeRequest {
+	t.Helper()
+
+	return newTestChallengeWithConfig(t, fqdn, key, testConfig())
+}
+
+func newTestChallengeWithConfig(t *testing.T, fqdn, key string, config begetDNSProviderConfig) *acme.ChallengeRequest {
+	t.Helper()
+
+	cfg, err := json.Marshal(config)
+	require.NoError(t, err)
+
+	return &acme.ChallengeRequest{
+		ResourceNamespace: "default",
+		ResolvedZone:      "example.com.",
+		ResolvedFQDN:      fqdn,
+		Key:               key,
+		Config:            &extapi.JSON{Raw: cfg},
+	}
 }
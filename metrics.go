@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "beget_webhook"
+
+// metrics of the solver, served on their own listener: the webhook's API
+// server is only reachable through the aggregation layer of the kube-apiserver
+type metrics struct {
+	registry *prometheus.Registry
+
+	apiRequests        *prometheus.CounterVec
+	apiRequestDuration *prometheus.HistogramVec
+	apiRetries         *prometheus.CounterVec
+	apiRateLimitWait   *prometheus.HistogramVec
+	challenges         *prometheus.CounterVec
+	challengeDuration  *prometheus.HistogramVec
+	credentialFailures *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		apiRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_requests_total",
+			Help:      "HTTP requests to the Beget API by method and result, every attempt of a retried call is counted.",
+		}, []string{"method", "result"}),
+		apiRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_request_duration_seconds",
+			Help:      "Duration of HTTP requests to the Beget API by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		apiRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_retries_total",
+			Help:      "Beget API calls attempted again after a failure by method.",
+		}, []string{"method"}),
+		apiRateLimitWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_rate_limit_wait_seconds",
+			Help:      "Time Beget API requests waited for the rate limit of their account by method.",
+			Buckets:   []float64{0, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"method"}),
+		challenges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "challenges_total",
+			Help:      "Present and CleanUp requests by operation and outcome.",
+		}, []string{"operation", "outcome"}),
+		challengeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "challenge_duration_seconds",
+			Help:      "Duration of Present and CleanUp requests by operation and outcome.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"operation", "outcome"}),
+		credentialFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "credential_lookup_failures_total",
+			Help:      "Failed lookups of Beget credentials by source.",
+		}, []string{"source"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.apiRequests,
+		m.apiRequestDuration,
+		m.apiRetries,
+		m.apiRateLimitWait,
+		m.challenges,
+		m.challengeDuration,
+		m.credentialFailures,
+	)
+
+	return m
+}
+
+func (m *metrics) ObserveRequest(method string, duration time.Duration, err error) {
+	m.apiRequests.WithLabelValues(method, resultOf(err)).Inc()
+	m.apiRequestDuration.WithLabelValues(method).Observe(duration.Seconds())
+}
+
+func (m *metrics) ObserveRetry(method string, _ int, _ error) {
+	m.apiRetries.WithLabelValues(method).Inc()
+}
+
+func (m *metrics) ObserveRateLimitWait(method string, wait time.Duration) {
+	m.apiRateLimitWait.WithLabelValues(method).Observe(wait.Seconds())
+}
+
+func (m *metrics) observeChallenge(operation string, duration time.Duration, err error) {
+	outcome := resultOf(err)
+	m.challenges.WithLabelValues(operation, outcome).Inc()
+	m.challengeDuration.WithLabelValues(operation, outcome).Observe(duration.Seconds())
+}
+
+func (m *metrics) observeCredentialFailure(source string) {
+	m.credentialFailures.WithLabelValues(source).Inc()
+}
+
+// resultOf classifies the error for the metric labels
+func resultOf(err error) string {
+	var apiErr *begetapi.APIError
+
+	switch {
+	case err == nil:
+		return "success"
+	case begetapi.IsAuthFailed(err):
+		return "auth_error"
+	case begetapi.IsRateLimited(err):
+		return "rate_limited"
+	case begetapi.IsNotFound(err):
+		return "not_found"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &apiErr):
+		return "api_error"
+	}
+
+	return "error"
+}
+
+// serveMetrics serves the metrics on addr until stopCh is closed
+func (m *metrics) serveMetrics(addr string, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+
+	klog.Infof("serving metrics on %s", addr)
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		klog.Errorf("serving metrics: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSolver_Metrics(t *testing.T) {
+	solver, _, mock := newTestSolverWithMock(t)
+
+	require.NoError(t, solver.Present(newTestChallenge(t, "_acme-challenge.example.com.", "challenge")))
+
+	mock.FailNext(1, http.StatusServiceUnavailable, "")
+	require.NoError(t, solver.CleanUp(newTestChallenge(t, "_acme-challenge.example.com.", "challenge")))
+
+	cfg := testConfig()
+	cfg.APILoginSecretRef.Name = "missing"
+	require.Error(t, solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.example.com.", "challenge", cfg)))
+
+	m := solver.metrics
+	require.Equal(t, 1.0, testutil.ToFloat64(m.challenges.WithLabelValues("present", "success")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.challenges.WithLabelValues("present", "error")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.challenges.WithLabelValues("cleanup", "success")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.apiRequests.WithLabelValues("dns/getData", "api_error")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.apiRetries.WithLabelValues("dns/getData")))
+	require.Equal(t, 2.0, testutil.ToFloat64(m.apiRequests.WithLabelValues("dns/changeRecords", "success")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.credentialFailures.WithLabelValues("secret")))
+
+	srv := httptest.NewServer(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	defer srv.Close()
+
+	rsp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `beget_webhook_challenges_total{operation="present",outcome="success"} 1`)
+}
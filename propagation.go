@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+const (
+	DefaultPropagationTimeout = 30 * time.Second
+	propagationInterval       = 2 * time.Second
+)
+
+// waitForPropagation polls the authoritative nameservers of the name until
+// all of them serve the key, beget publishes the records with a delay
+func (e *Solver) waitForPropagation(ctx context.Context, fqdn, key string) error {
+	nameservers := e.authoritativeNameservers
+	if len(nameservers) == 0 {
+		var err error
+		nameservers, err = e.lookupAuthoritativeNameservers(ctx, fqdn)
+		if err != nil {
+			return fmt.Errorf("finding authoritative nameservers of %s: %w", fqdn, err)
+		}
+	}
+
+	timeout := e.propagationTimeout
+	if timeout <= 0 {
+		timeout = DefaultPropagationTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	name := dns.Fqdn(fqdn)
+	pending := nameservers
+	for {
+		var notYet []string
+		for _, ns := range pending {
+			if !servesTXT(ctx, ns, name, key) {
+				notYet = append(notYet, ns)
+			}
+		}
+
+		if len(notYet) == 0 {
+			klog.Infof("solver.waitForPropagation: %s is served by %s", fqdn, strings.Join(nameservers, ", "))
+
+			return nil
+		}
+		pending = notYet
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("TXT record of %s is not served by %s yet: %w", fqdn, strings.Join(pending, ", "), ctx.Err())
+		case <-time.After(propagationInterval):
+		}
+	}
+}
+
+// servesTXT reports whether the nameserver has the value among the TXT records of the name
+func servesTXT(ctx context.Context, nameserver, name, value string) bool {
+	in, err := exchange(ctx, []string{nameserver}, name, dns.TypeTXT)
+	if err != nil {
+		klog.Infof("solver.servesTXT: %v", err)
+
+		return false
+	}
+
+	for _, rr := range in.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupAuthoritativeNameservers returns the addresses of the nameservers of
+// the closest zone cut above the name, found with the resolvers
+func (e *Solver) lookupAuthoritativeNameservers(ctx context.Context, fqdn string) ([]string, error) {
+	resolvers, err := e.resolvers()
+	if err != nil {
+		return nil, err
+	}
+
+	labels := dns.SplitDomainName(fqdn)
+	for i := range labels {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+
+		in, err := exchange(ctx, resolvers, zone, dns.TypeNS)
+		if err != nil {
+			return nil, err
+		}
+
+		var hosts []string
+		for _, rr := range in.Answer {
+			if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, zone) {
+				hosts = append(hosts, ns.Ns)
+			}
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+
+		var nameservers []string
+		for _, host := range hosts {
+			addrs, err := lookupAddresses(ctx, resolvers, host)
+			if err != nil {
+				klog.Infof("solver.lookupAuthoritativeNameservers: %v", err)
+
+				continue
+			}
+			for _, addr := range addrs {
+				nameservers = append(nameservers, net.JoinHostPort(addr, "53"))
+			}
+		}
+		if len(nameservers) == 0 {
+			return nil, fmt.Errorf("no address of the nameservers %s of %s is found", strings.Join(hosts, ", "), zone)
+		}
+
+		return nameservers, nil
+	}
+
+	return nil, fmt.Errorf("no NS records found for %s", fqdn)
+}
+
+func lookupAddresses(ctx context.Context, resolvers []string, host string) ([]string, error) {
+	in, err := exchange(ctx, resolvers, host, dns.TypeA)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, rr := range in.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			addrs = append(addrs, a.A.String())
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no address", host)
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSolver_VerifyPropagation(t *testing.T) {
+	solver, _, mock := newTestSolverWithMock(t)
+	solver.authoritativeNameservers = []string{startTestDNS(t, mock)}
+
+	cfg := testConfig()
+	cfg.VerifyPropagation = true
+	require.NoError(t, solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.example.com.", "challenge", cfg)))
+
+	// a nameserver the record hasn't reached yet
+	stale := begetapi.NewBegetApiMock("login", "password")
+	staleAddr := startTestDNS(t, stale)
+	solver.authoritativeNameservers = append(solver.authoritativeNameservers, staleAddr)
+	solver.propagationTimeout = 100 * time.Millisecond
+
+	err := solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.example.com.", "other", cfg))
+	require.ErrorContains(t, err, "TXT record of _acme-challenge.example.com is not served by "+staleAddr+" yet")
+}
+
+func TestSolver_LookupAuthoritativeNameservers(t *testing.T) {
+	solver, _, mock := newTestSolverWithMock(t)
+	solver.nameservers = []string{startTestDNS(t, mock)}
+
+	// the zone is delegated to beget's nameservers the mock doesn't resolve
+	_, err := solver.lookupAuthoritativeNameservers(context.TODO(), "_acme-challenge.example.com")
+	require.ErrorContains(t, err, "no address of the nameservers ns1.beget.com., ns2.beget.com. of example.com.")
+
+	require.NoError(t, mock.SetRecords("example.com", begetapi.Records{NS: []begetapi.NSRecord{{NSDName: "ns1.example.com"}}}))
+	_, err = mock.AddSubdomain("ns1.example.com")
+	require.NoError(t, err)
+	require.NoError(t, mock.SetRecords("ns1.example.com", begetapi.Records{A: []begetapi.ARecord{{Address: "127.0.0.1"}}}))
+
+	nameservers, err := solver.lookupAuthoritativeNameservers(context.TODO(), "_acme-challenge.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.1:53"}, nameservers)
+
+	require.Equal(t, []string{"ns1.beget.com:53", "127.0.0.1:5353"}, parseNameservers("ns1.beget.com, 127.0.0.1:5353,"))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	secretCacheResync = 10 * time.Minute
+	// secretCacheSyncTimeout bounds waiting for the cache of a secret, an
+	// informer forbidden to list it never syncs
+	secretCacheSyncTimeout = time.Second
+)
+
+// secretCache serves secrets from informers, so lookups don't hit the API
+// server on every challenge and rotated credentials are picked up by a watch.
+// An informer is started per secret on its first lookup, selecting it by its
+// name: only the secrets issuers refer to are cached, never whole namespaces
+// with the private keys of their certificates.
+type secretCache struct {
+	client kubernetes.Interface
+	stopCh <-chan struct{}
+
+	mu      sync.Mutex
+	secrets map[string]*cachedSecret
+}
+
+type cachedSecret struct {
+	lister corelisters.SecretNamespaceLister
+	synced cache.InformerSynced
+}
+
+func newSecretCache(client kubernetes.Interface, stopCh <-chan struct{}) *secretCache {
+	return &secretCache{
+		client:  client,
+		stopCh:  stopCh,
+		secrets: make(map[string]*cachedSecret),
+	}
+}
+
+// Get returns the secret from the cache, falling back to the API server if
+// the cache of the secret doesn't sync shortly and for secrets it hasn't
+// seen yet
+func (c *secretCache) Get(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	secret := c.forSecret(namespace, name)
+
+	if secret.waitForSync(ctx) {
+		sec, err := secret.lister.Get(name)
+		if err == nil {
+			return sec, nil
+		}
+		if !k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		klog.Infof("secretCache: secret \"%s/%s\" is not cached yet", namespace, name)
+	}
+
+	return c.client.CoreV1().Secrets(namespace).Get(ctx, name, v1.GetOptions{})
+}
+
+// waitForSync waits a little for the cache to sync, the caller's context is
+// left for the lookup in the API server
+func (s *cachedSecret) waitForSync(ctx context.Context) bool {
+	if s.synced() {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, secretCacheSyncTimeout)
+	defer cancel()
+
+	return cache.WaitForCacheSync(ctx.Done(), s.synced)
+}
+
+func (c *secretCache) forSecret(namespace, name string) *cachedSecret {
+	key := namespace + "/" + name
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if secret, ok := c.secrets[key]; ok {
+		return secret
+	}
+
+	klog.Infof("secretCache: starting informer of secret %q", key)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(c.client, secretCacheResync,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *v1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	informer := factory.Core().V1().Secrets()
+
+	// managed fields are of no use here and take a good part of the memory
+	informer.Informer().SetTransform(func(obj interface{}) (interface{}, error) {
+		if sec, ok := obj.(*corev1.Secret); ok {
+			sec.ManagedFields = nil
+		}
+
+		return obj, nil
+	})
+
+	secret := &cachedSecret{
+		lister: informer.Lister().Secrets(namespace),
+		synced: informer.Informer().HasSynced,
+	}
+	c.secrets[key] = secret
+
+	factory.Start(c.stopCh)
+
+	return secret
+}
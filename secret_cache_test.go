@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSolver_CredentialsCache(t *testing.T) {
+	solver, _ := newTestSolver(t)
+	client := solver.k8sClient.(*fake.Clientset)
+	login := testSecretRef("beget-credentials", "login")
+	passwd := testSecretRef("beget-credentials", "passwd")
+
+	for i := 0; i < 5; i++ {
+		creds, err := solver.credentials(context.TODO(), "default", login, passwd)
+		require.NoError(t, err)
+		require.Equal(t, begetapi.Credentials{Login: "login", Passwd: "password"}, creds)
+	}
+
+	for _, action := range client.Actions() {
+		require.NotEqual(t, "get", action.GetVerb(), "secrets are expected to be served from the cache")
+	}
+
+	_, err := client.CoreV1().Secrets("default").Update(context.TODO(), &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "beget-credentials", Namespace: "default"},
+		Data: map[string][]byte{
+			"login":  []byte("login"),
+			"passwd": []byte("rotated"),
+		},
+	}, v1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		creds, err := solver.credentials(context.TODO(), "default", login, passwd)
+		return err == nil && creds.Passwd == "rotated"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a secret the informer hasn't delivered yet is looked up in the API server
+	_, err = client.CoreV1().Secrets("default").Create(context.TODO(), &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "other-credentials", Namespace: "default"},
+		Data:       map[string][]byte{"login": []byte("other")},
+	}, v1.CreateOptions{})
+	require.NoError(t, err)
+
+	other := testSecretRef("other-credentials", "login")
+	creds, err := solver.credentials(context.TODO(), "default", other, other)
+	require.NoError(t, err)
+	require.Equal(t, "other", creds.Login)
+}
+
+func TestSecretCache_ListForbidden(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "beget-credentials", Namespace: "default"},
+		Data:       map[string][]byte{"login": []byte("login")},
+	})
+	// e.g. RBAC granting only get on secrets of the namespace
+	for _, verb := range []string{"list", "watch"} {
+		client.PrependReactor(verb, "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, k8serrors.NewForbidden(corev1.Resource("secrets"), "", errors.New("forbidden"))
+		})
+	}
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	secrets := newSecretCache(client, stopCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	sec, err := secrets.Get(ctx, "default", "beget-credentials")
+	require.NoError(t, err)
+	require.Equal(t, "login", string(sec.Data["login"]))
+	require.Less(t, time.Since(start), 3*time.Second, "the lookup is expected to fall back to the API server promptly")
+}
+
+func TestSecretCache_SelectsReferencedSecrets(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "beget-credentials", Namespace: "default"},
+		Data:       map[string][]byte{"login": []byte("login")},
+	})
+
+	var mu sync.Mutex
+	selectors := make(map[string]bool)
+	for _, verb := range []string{"list", "watch"} {
+		client.PrependReactor(verb, "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			var selector fields.Selector
+			switch a := action.(type) {
+			case k8stesting.ListAction:
+				selector = a.GetListRestrictions().Fields
+			case k8stesting.WatchAction:
+				selector = a.GetWatchRestrictions().Fields
+			}
+			selectors[action.GetNamespace()+"?"+selector.String()] = true
+
+			return false, nil, nil
+		})
+	}
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	secrets := newSecretCache(client, stopCh)
+
+	sec, err := secrets.Get(context.TODO(), "default", "beget-credentials")
+	require.NoError(t, err)
+	require.Equal(t, "login", string(sec.Data["login"]))
+
+	// the other secrets of the namespace, e.g. of certificates, aren't cached
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, map[string]bool{"default?metadata.name=beget-credentials": true}, selectors)
+}
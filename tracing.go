@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	acme "github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName  = "github.com/boryashkin/cert-manager-webhook-beget"
+	serviceName = "cert-manager-webhook-beget"
+)
+
+// setupTracing installs the global tracer provider exporting spans over OTLP,
+// if an endpoint is given in the standard OTEL_EXPORTER_OTLP_* variables; the
+// exporter reads the rest of its configuration from the environment as well
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName(serviceName)),
+		resource.Default(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// startChallengeSpan starts the span of a Present or CleanUp request, the key
+// of the challenge is a secret and stays out of it
+func (e *Solver) startChallengeSpan(ctx context.Context, operation string, ch *acme.ChallengeRequest) (context.Context, trace.Span) {
+	var attrs []attribute.KeyValue
+	if ch != nil {
+		attrs = append(attrs,
+			semconv.K8SNamespaceName(ch.ResourceNamespace),
+			attribute.String("acme.dns_name", ch.DNSName),
+			attribute.String("acme.resolved_zone", ch.ResolvedZone),
+			attribute.String("acme.resolved_fqdn", ch.ResolvedFQDN),
+		)
+	}
+
+	return e.tracer.Start(ctx, "beget."+operation, trace.WithAttributes(attrs...))
+}
+
+func recordSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
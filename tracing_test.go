@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boryashkin/cert-manager-webhook-beget/begetapi"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSolver_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	solver, _ := newTestSolver(t, begetapi.WithTracerProvider(provider))
+	solver.tracer = provider.Tracer(tracerName)
+
+	require.NoError(t, solver.Present(newTestChallenge(t, "_acme-challenge.example.com.", "secret-challenge-key")))
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+
+		// neither the challenge key nor the password may leak into the spans
+		for _, attr := range span.Attributes {
+			require.NotContains(t, attr.Value.Emit(), "secret-challenge-key", span.Name)
+			require.NotContains(t, attr.Value.Emit(), "password", span.Name)
+		}
+	}
+
+	present, ok := spans["beget.present"]
+	require.True(t, ok)
+	require.Contains(t, present.Attributes, attribute.String("k8s.namespace.name", "default"))
+	require.Contains(t, present.Attributes, attribute.String("acme.resolved_zone", "example.com."))
+	require.Contains(t, present.Attributes, attribute.String("beget.fqdn", "_acme-challenge.example.com"))
+
+	for _, name := range []string{"beget.secret", "beget dns/getData", "beget dns/changeRecords"} {
+		require.Contains(t, spans, name)
+		require.Equal(t, present.SpanContext.SpanID(), spans[name].Parent.SpanID(), name)
+	}
+
+	httpSpan, ok := spans["POST /api/dns/changeRecords"]
+	require.True(t, ok)
+	require.Equal(t, spans["beget dns/changeRecords"].SpanContext.SpanID(), httpSpan.Parent.SpanID())
+
+	// failures are recorded on the span of the challenge
+	exporter.Reset()
+	cfg := testConfig()
+	cfg.APILoginSecretRef.Name = "missing"
+	require.Error(t, solver.Present(newTestChallengeWithConfig(t, "_acme-challenge.example.com.", "challenge", cfg)))
+
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "beget.present" || span.Name == "beget.secret" {
+			require.Equal(t, codes.Error, span.Status.Code, span.Name)
+		}
+	}
+}